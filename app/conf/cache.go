@@ -0,0 +1,56 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package conf
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cache keeps the max most recently used values, by source string.
+// Sources may be built from the requests, so the least recently used
+// values are removed.
+type cache struct {
+	max  int
+	lock sync.Mutex
+	// *cacheEntry, most recently used first
+	order *list.List
+	byKey map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key   string
+	value interface{}
+}
+
+func newCache(max int) *cache {
+	return &cache{max: max, order: list.New(),
+		byKey: map[string]*list.Element{}}
+}
+
+// Returns the value of key, nil if it's not in cache
+func (c *cache) get(key string) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.byKey[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).value
+}
+
+func (c *cache) add(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.byKey[key]; ok {
+		return
+	}
+	c.byKey[key] = c.order.PushFront(&cacheEntry{key, value})
+	if c.order.Len() > c.max {
+		last := c.order.Remove(c.order.Back()).(*cacheEntry)
+		delete(c.byKey, last.key)
+	}
+}
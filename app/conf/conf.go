@@ -11,6 +11,7 @@ import (
 	"os"
 	"reflect"
 
+	"github.com/PaesslerAG/gval"
 	"github.com/jsautret/genapid/app/utils"
 	"github.com/jsautret/genapid/ctx"
 	"github.com/mitchellh/mapstructure"
@@ -37,39 +38,97 @@ type Params struct {
 	Conf map[string]interface{}
 }
 
-// ReadConfFile reads the YAML config file and returns Root config
-func ReadConfFile(filename string) Root {
-	cfg := ReadFile(filename)
-	processInclude(cfg)
+// Config is a configuration read from a file
+type Config struct {
+	Root Root
+	// YAML document Root was decoded from
+	Node *yaml.Node
+	// Main conf file and files it includes
+	Files []string
+	// Gval expressions found in the conf, compiled, by source
+	// string. Set in the ctx.Ctx of the conf when it is loaded.
+	Expressions map[string]gval.Evaluable
+	// file each included predicate comes from
+	origins map[*yaml.Node]string
+}
+
+// FileOf returns the file predicate node n was read from, parent being
+// the file of its parent node
+func (c *Config) FileOf(n *yaml.Node, parent string) string {
+	if f, ok := c.origins[n]; ok {
+		return f
+	}
+	return parent
+}
+
+// ReadConfFile reads the YAML config file and returns its config. If
+// the conf is invalid, the returned error is an Errors containing all
+// the problems found.
+func ReadConfFile(filename string) (*Config, error) {
+	cfg, err := ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	l := loader{}
+	l.processInclude(cfg, filename)
+	if len(l.errs) != 0 {
+		return nil, l.errs
+	}
 	root := Root{}
 	if err := cfg.Decode(&root); err != nil {
-		log.Fatal().Err(err).Msg("Conf file is not a list")
+		return nil, yamlErrors(filename, err)
+	}
+	c := &Config{
+		Root:        root,
+		Node:        cfg,
+		Files:       []string{filename},
+		Expressions: map[string]gval.Evaluable{},
+		origins:     l.origins,
+	}
+	compileNode(cfg, c.Expressions)
+	seen := map[string]bool{filename: true}
+	for _, f := range l.files {
+		if !seen[f] {
+			seen[f] = true
+			c.Files = append(c.Files, f)
+		}
 	}
-	return root
+	return c, nil
 }
 
 // ReadFile reads the YAML config file and returns document as a
-// yaml.Node
-func ReadFile(filename string) *yaml.Node {
+// yaml.Node. The returned error is an Errors.
+func ReadFile(filename string) (*yaml.Node, error) {
 	log.Info().Str("filename", filename).Msg("Reading configuration file")
 
 	handle, err := os.Open(filename)
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		if e, ok := err.(*os.PathError); ok {
+			// file name is already in Error
+			err = e.Err
+		}
+		return nil, Errors{{File: filename, Err: err}}
 	}
 
 	defer utils.CloseQuietly(handle)
-	return Read(handle)
+	n, err := Read(handle)
+	if err != nil {
+		return nil, yamlErrors(filename, err)
+	}
+	return n, nil
 }
 
 // Read reads the reader as YAML and return Root config
-func Read(r io.Reader) *yaml.Node {
+func Read(r io.Reader) (*yaml.Node, error) {
 	conf := yaml.Node{}
 	d := yaml.NewDecoder(r)
 	if err := d.Decode(&conf); err != nil {
-		log.Fatal().Err(err).Msg("")
+		if err == io.EOF {
+			err = errors.New("empty document")
+		}
+		return nil, err
 	}
-	return &conf
+	return &conf, nil
 }
 
 // AddDefault adds predicate default parameters to context
@@ -109,21 +168,30 @@ func GetPredicateParams(ctx *ctx.Ctx, config *Params, params interface{}) bool {
 
 // GetParams from a map & evaluate Gval expressions in it
 func GetParams(ctx *ctx.Ctx, config interface{}, params interface{}) bool {
+	if err := DecodeParams(ctx, config, params); err != nil {
+		log.Error().Err(err).Msg("Incorrect fields")
+		return false
+	}
+	return true
+}
+
+// DecodeParams from a map & evaluate Gval expressions in it
+func DecodeParams(ctx *ctx.Ctx, config interface{}, params interface{}) error {
 	log.Trace().Interface("in", config).Msg("Params conversion")
 	c := mapstructure.DecoderConfig{
 		DecodeHook: hookGval(ctx),
 		ZeroFields: false, // needed for 'default' field
 		Result:     params,
 	}
-	if decode, err := mapstructure.NewDecoder(&c); err != nil {
-		log.Error().Err(err).Msg("Decoder error")
-		return false
-	} else if err := decode.Decode(config); err != nil {
-		log.Error().Err(err).Msg("Incorrect fields")
-		return false
+	decode, err := mapstructure.NewDecoder(&c)
+	if err != nil {
+		return err
+	}
+	if err := decode.Decode(config); err != nil {
+		return err
 	}
 	log.Trace().Interface("out", params).Msg("Params conversion")
-	return true
+	return nil
 }
 
 // Evaluate Gval expressions while mapping data to params
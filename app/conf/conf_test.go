@@ -5,10 +5,15 @@
 package conf
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"strings"
 	"testing"
 
+	"github.com/PaesslerAG/gval"
 	"github.com/go-test/deep"
 	"github.com/jsautret/genapid/ctx"
 	"github.com/rs/zerolog"
@@ -261,6 +266,133 @@ l1:
 				L1: []string{"l11", "l12"},
 			},
 		},
+		{
+			name: "Encoding",
+			conf: `
+s1: '="v0=" + hmacSha256("secret", "v0:" + "1615734566" + ":" + toJSON({"a": [1, "b"]}))'
+s2: '=base64Encode("user:pass")'
+i:
+  - '=base64Decode("dXNlcjpwYXNz")'
+  - '=base64Decode("YQ")'
+  - '=urlEncode("a b&c")'
+  - '=urlDecode("a+b%26c")'
+  - '=urlEncode({"q": "a b", "l": [1, 2]})'
+  - '=sha256("abc")'
+  - '=sha1("abc")'
+  - '=md5("abc")'
+  - '=hex("abc")'
+  - '=fromJSON("{\"a\": [1, true]}")|a[1]'
+  - '=toYAML({"a": ["b"]})'
+  - '=secureCompare("token", "token") && !secureCompare("token", "tokeN")'
+`,
+			expected: params{
+				S1: "v0=2bfeb85d500498e5ff4e234102fee70be83c739982e984b8ad1f0f3acba1eb39",
+				S2: "dXNlcjpwYXNz",
+				I: []interface{}{
+					"user:pass", "a", "a+b%26c", "a b&c", "l=1&l=2&q=a+b",
+					"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+					"a9993e364706816aba3e25717850c26c9cd0d89d",
+					"900150983cd24fb0d6963f7d28e17f72",
+					"616263", true, "a:\n    - b\n", true,
+				},
+			},
+		},
+		{
+			name: "Collections",
+			conf: `
+s1: '=join(sort(unique(split("b,a,c,a", ","))), "-")'
+s2: '=join(keys(omit(merge(V.variable3, {"f4": 4}), "f1", ["f2"])), ",")'
+i:
+  - '=[len("été"), len(V.variable3), len(V.fuzzy)]'
+  - '=values(pick(V.variable3, "f1", "f3", "none"))'
+  - '=[contains(V.fuzzy, "wheel"), contains(V.variable3, "f9"), contains("foobar", "oba"), contains([1, 2], 2)]'
+  - '=sort([10, 9, 100])'
+  - '=sort([{"n": "b", "v": 1}, {"n": "a", "v": 2}], "n")|$[0].v'
+  - '=[first(V.fuzzy), last(V.fuzzy), first([])]'
+  - '=[slice(V.fuzzy, 1, -1), slice("genapid", -3), slice([1], 5)]'
+`,
+			expected: params{
+				S1: "a-b-c",
+				S2: "f3,f4",
+				I: []interface{}{
+					[]interface{}{3, 3, 4},
+					[]interface{}{"value31", "value33"},
+					[]interface{}{true, false, true, true},
+					[]interface{}{float64(9), float64(10), float64(100)},
+					float64(2),
+					[]interface{}{"cartwheel", "baz", nil},
+					[]interface{}{
+						[]interface{}{"foobar", "wheel"}, "pid",
+						[]interface{}{},
+					},
+				},
+			},
+		},
+		{
+			name: "Strings",
+			conf: `
+s1: '=fuzzy(normalize(lower("Mettre la Télé en PAUSE")), ["mettre la tele en pause", "mettre la tele en route"])'
+s2: '=title(trim(replace("  hello_world  ", "_", " ")))'
+i:
+  - '=trim("--a-b--", "-")'
+  - '=regexReplace("play the movie Alien", "^play (the movie )?(?P<title>.+)$", "${title} is playing")'
+  - '=regexFind("play the song Help", "play the (song|album) (.+)")'
+  - '=regexFind("play the song Help", "play the (?P<kind>song|album) (.+)", "kind")'
+  - '=regexFind("play the song Help", "play the (song|album) (.+)", 2)'
+  - '=regexFind("nothing", "play")'
+  - '=[hasPrefix("genapid", "gen"), hasSuffix("genapid", "gen")]'
+  - '=[truncate("Déjà vu", 4, "…"), truncate("abc", 3, "…")]'
+  - '=[padLeft("7", 3, "0"), padLeft(42, 4), padRight("ab", 5, "-.")]'
+`,
+			expected: params{
+				S1: "mettre la tele en pause",
+				S2: "Hello World",
+				I: []interface{}{
+					"a-b",
+					"Alien is playing",
+					"play the song Help",
+					"song",
+					"Help",
+					"",
+					[]interface{}{true, false},
+					[]interface{}{"Déjà…", "abc"},
+					[]interface{}{"007", "  42", "ab-.-"},
+				},
+			},
+		},
+		{
+			name: "Template",
+			conf: `
+s1: '=tpl("{{ .V.variable1 }} {{ .In.Method | lower }}")'
+s2: '=tpl("{{ range .V.variable2 }}{{ upper . }} {{ end }}")'
+`,
+			expected: params{
+				S1: "value1 post",
+				S2: "VALUE21 VALUE22 ",
+			},
+		},
+		{
+			name: "Time",
+			conf: `
+s1: '=formatTime("RFC3339", inZone(fromUnix(1615734566), "Europe/Paris"))'
+s2: '=formatTime("DateTime", addTime(parseTime("DateOnly", "2021-03-14"), "36h"))'
+i:
+  - '=weekday("2021-03-14T15:09:26Z")'
+  - '=hour(inZone("2021-03-14T15:09:26Z", "Asia/Tokyo"))'
+  - '=timeDiff("2021-03-14T15:09:26Z", fromUnix(1615734000))'
+  - '=duration("1h30m") + 60'
+  - '=unix(parseTime("02/01/2006 15:04", "14/03/2021 16:09", "Europe/Paris"))'
+  - '=before(now(), addTime(now(), 1)) && since(unix() - 3600) >= 3600'
+`,
+			expected: params{
+				S1: "2021-03-14T16:09:26+01:00",
+				S2: "2021-03-15 12:00:00",
+				I: []interface{}{
+					"Sunday", 0, float64(566), float64(5460),
+					int64(1615734540), true,
+				},
+			},
+		},
 	}
 	zerolog.SetGlobalLevel(logLevel)
 	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
@@ -299,6 +431,7 @@ func TestRead(t *testing.T) {
 		conf       string
 		pipes      int
 		predicates []int
+		files      []string
 	}{
 		{
 			name: "OnePipe",
@@ -356,6 +489,12 @@ func TestRead(t *testing.T) {
 `,
 			pipes:      3,
 			predicates: []int{5, 6, 3},
+			files: []string{
+				"testdata/3predicates.yml",
+				"testdata/pipe6predicates.yml",
+				"testdata/3predicates.yml",
+				"testdata/3predicates.yml",
+			},
 		},
 	}
 	zerolog.SetGlobalLevel(logLevel)
@@ -363,9 +502,12 @@ func TestRead(t *testing.T) {
 		With().Caller().Timestamp().Logger()
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			r := Read(strings.NewReader(tc.conf))
-			assert.NotNil(t, r, "Wrong Read")
-			processInclude(r)
+			r, err := Read(strings.NewReader(tc.conf))
+			require.Nil(t, err, "Wrong Read")
+			l := loader{}
+			l.processInclude(r, "test")
+			require.Nil(t, l.errs, "Wrong include")
+			assert.Equal(t, tc.files, l.files, "wrong included files")
 			cfg := Root{}
 			assert.Nil(t, r.Decode(&cfg))
 			if err := r.Decode(&cfg); err != nil {
@@ -387,6 +529,174 @@ func TestRead(t *testing.T) {
 
 }
 
+func TestReadErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		expected []string
+	}{
+		{
+			name: "Missing",
+			file: "testdata/none.yml",
+			expected: []string{
+				"testdata/none.yml: no such file or directory",
+			},
+		},
+		{
+			name: "Syntax",
+			file: "testdata/syntax.yml",
+			expected: []string{
+				"testdata/syntax.yml:2: did not find expected '-' indicator",
+			},
+		},
+		{
+			name: "Errors",
+			file: "testdata/errors.yml",
+			expected: []string{
+				"testdata/errors.yml:6:7: Predicate must be dict",
+				"testdata/errors.yml:7:7: included file testdata/missing.yml: no such file or directory",
+				"testdata/errors_include.yml:4:9: Toplevel conf & 'pipe' content must be a list",
+				"testdata/errors_include.yml:5:3: Predicate must be dict",
+				"testdata/errors.yml:11:5: Toplevel conf & 'pipe' content must be a list",
+			},
+		},
+	}
+	zerolog.SetGlobalLevel(logLevel)
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().Caller().Timestamp().Logger()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := ReadConfFile(tc.file)
+			assert.Nil(t, cfg)
+			var errs Errors
+			require.True(t, errors.As(err, &errs), "not Errors: %v", err)
+			msgs := make([]string, len(errs))
+			for i, e := range errs {
+				msgs[i] = e.Error()
+			}
+			assert.Equal(t, tc.expected, msgs)
+		})
+	}
+}
+
+// Functions whose arguments may come from the requests must not use
+// unbounded memory
+func TestStringLimits(t *testing.T) {
+	_, err := evaluateGval(`=padLeft("x", 1e12)`, ctx.New())
+	assert.NotNil(t, err, "padding too long")
+	v, err := evaluateGval(`=truncate("hello", 1e19, "...")`, ctx.New())
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", v)
+	v, err = evaluateGval(`=padRight("x", 4, "abcdefghij")`, ctx.New())
+	assert.Nil(t, err)
+	assert.Equal(t, "xabc", v)
+
+	for i := 0; i < maxRegexps+10; i++ {
+		_, err := compileRegexp(fmt.Sprintf("^%v$", i))
+		require.Nil(t, err)
+	}
+	assert.Equal(t, maxRegexps, regexps.order.Len())
+	assert.Len(t, regexps.byKey, maxRegexps)
+	assert.Nil(t, regexps.get("^0$"), "least recently used removed")
+	assert.NotNil(t, regexps.get(fmt.Sprintf("^%v$", maxRegexps+9)))
+
+	for i := 0; i < maxTemplates+10; i++ {
+		_, err := RenderTemplate(fmt.Sprintf("{{/* %v */}}", i), ctx.New())
+		require.Nil(t, err)
+	}
+	assert.Equal(t, maxTemplates, templates.order.Len())
+	assert.Len(t, templates.byKey, maxTemplates)
+}
+
+// Time zones must be found without zoneinfo files. As they are looked
+// up only once, the test is run again in a new process with ZONEINFO
+// set.
+func TestTimeZoneData(t *testing.T) {
+	if os.Getenv("ZONEINFO") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=TestTimeZoneData")
+		cmd.Env = append(os.Environ(), "ZONEINFO=/nonexistent/zoneinfo.zip")
+		out, err := cmd.CombinedOutput()
+		assert.Nil(t, err, "%s", out)
+		return
+	}
+	v, err := evaluateGval(`=hour(inZone("2021-03-14T15:09:26Z", "Asia/Tokyo"))`,
+		ctx.New())
+	require.Nil(t, err)
+	assert.Equal(t, 0, v)
+	_, err = evaluateGval(`=parseTime("2006-01-02 15:04", "2021-03-14 15:09", "Europe/Paris")`,
+		ctx.New())
+	assert.Nil(t, err)
+}
+
+func TestCompile(t *testing.T) {
+	n, err := Read(strings.NewReader(`
+- match:
+    string: =In.Method + "compiled"
+    value: "=invalid +"
+- variable:
+    - list: ["=1 + 41", "not compiled"]
+`))
+	require.Nil(t, err)
+	exprs := map[string]gval.Evaluable{}
+	compileNode(n, exprs)
+	for _, s := range []string{`=In.Method + "compiled"`, "=1 + 41"} {
+		_, ok := exprs[s]
+		assert.True(t, ok, "not compiled: %v", s)
+	}
+	for _, s := range []string{"=invalid +", "not compiled"} {
+		_, ok := exprs[s]
+		assert.False(t, ok, "compiled: %v", s)
+	}
+	c := ctx.New()
+	v, err := evaluateGval("=1 + 41", c)
+	assert.Nil(t, err)
+	assert.Equal(t, 42.0, v)
+
+	// compiled expressions of the ctx are used
+	c.Expressions = map[string]gval.Evaluable{
+		"=1 + 41": func(context.Context, interface{}) (interface{}, error) {
+			return "compiled", nil
+		},
+	}
+	v, err = evaluateGval("=1 + 41", c)
+	assert.Nil(t, err)
+	assert.Equal(t, "compiled", v)
+}
+
+const benchExpression = `=R.x.value + " " + upper(V.name) + " " + format("%v", V.n * 2)`
+
+func benchContext() *ctx.Ctx {
+	c := ctx.New()
+	c.R["x"] = ctx.Result{"value": "hello"}
+	c.V["name"] = "world"
+	c.V["n"] = 21
+	return c
+}
+
+// Expression compiled when the conf is loaded
+func BenchmarkCompiledExpression(b *testing.B) {
+	c := benchContext()
+	e, err := compile(benchExpression)
+	require.Nil(b, err)
+	c.Expressions = map[string]gval.Evaluable{benchExpression: e}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := evaluateGval(benchExpression, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Baseline: expression parsed on each evaluation
+func BenchmarkParsedExpression(b *testing.B) {
+	c := benchContext()
+	for i := 0; i < b.N; i++ {
+		if _, err := gvalLanguage.Evaluate(benchExpression[1:], c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestDefault(t *testing.T) {
 	cases := []struct {
 		name     string
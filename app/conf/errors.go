@@ -0,0 +1,90 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Error is a problem found in a conf file
+type Error struct {
+	File   string
+	Line   int // 0 if unknown
+	Column int // 0 if unknown
+	Err    error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line != 0 {
+		fmt.Fprintf(&b, "%d:", e.Line)
+		if e.Column != 0 {
+			fmt.Fprintf(&b, "%d:", e.Column)
+		}
+	}
+	if b.Len() != 0 {
+		b.WriteString(" ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors is a list of problems found in conf files
+type Errors []*Error
+
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Return an error located at node n in file
+func nodeError(file string, n *yaml.Node, err error) *Error {
+	e := &Error{File: file, Err: err}
+	if n != nil {
+		e.Line = n.Line
+		e.Column = n.Column
+	}
+	return e
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Convert errors returned by the YAML parser, which may contain
+// several problems with their line number in their message
+func yamlErrors(file string, err error) Errors {
+	var msgs []string
+	if e, ok := err.(*yaml.TypeError); ok {
+		msgs = e.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+	errs := make(Errors, len(msgs))
+	for i, m := range msgs {
+		errs[i] = &Error{File: file, Err: errors.New(m)}
+		if r := yamlLine.FindStringSubmatch(m); r != nil {
+			errs[i].Line, _ = strconv.Atoi(r[1])
+			errs[i].Err = errors.New(r[2])
+		}
+	}
+	return errs
+}
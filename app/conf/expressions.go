@@ -25,21 +25,99 @@ import (
 	"github.com/jsautret/genapid/ctx"
 	fuzzysearch "github.com/lithammer/fuzzysearch/fuzzy"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
 )
 
+// Gval language with all extensions, built once
+var gvalLanguage = gval.Full(extensions()...)
+
+// Functions added to Gval, by name. They are also available in
+// templates.
+var functions = map[string]func(...interface{}) (interface{}, error){}
+
+// Key of the ctx.Ctx in the context.Context passed to Gval functions
+type ctxKey struct{}
+
 // Evaluate string if it's a Gval expression and return its value
 func evaluateGval(s string, c *ctx.Ctx) (interface{}, error) {
-	if s != "" && s[0] == '=' {
-		return gval.Evaluate(s[1:], c,
-			jsonpath.Language(), jsonpathFunction(),
-			pipeOperator(), fuzzyFunction(), formatFunction(),
-			lenFunction(), upperFunction(), hmacSha256Function(),
-			hmacSha1Function(), dirFunction(), baseFunction(),
-			urlFunction())
+	if IsExpression(s) {
+		var e gval.Evaluable
+		if c != nil {
+			e = c.Expressions[s]
+		}
+		if e == nil {
+			// not in the conf, like the expressions of tests
+			var err error
+			if e, err = compile(s); err != nil {
+				return nil, err
+			}
+		}
+		return e(context.WithValue(context.Background(), ctxKey{}, c), c)
 	}
 	return s, nil
 }
 
+// Returns a Gval function & adds it to functions. The function gets a
+// context.Context so Gval calls it directly, without starting a
+// goroutine.
+func function(name string, f func(...interface{}) (interface{}, error)) gval.Language {
+	functions[name] = f
+	return gval.Function(name,
+		func(_ context.Context, arguments ...interface{}) (interface{}, error) {
+			return f(arguments...)
+		})
+}
+
+// Returns the compiled expression s
+func compile(s string) (gval.Evaluable, error) {
+	return gvalLanguage.NewEvaluable(s[1:])
+}
+
+// Compile all the Gval expressions found in node n and add them to
+// exprs, by source string, so they are not parsed again when
+// evaluated. Invalid expressions are ignored here and reported when
+// evaluated.
+func compileNode(n *yaml.Node, exprs map[string]gval.Evaluable) {
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" &&
+		IsExpression(n.Value) {
+		if _, ok := exprs[n.Value]; !ok {
+			if e, err := compile(n.Value); err == nil {
+				exprs[n.Value] = e
+			}
+		}
+	}
+	for _, child := range n.Content {
+		compileNode(child, exprs)
+	}
+}
+
+// IsExpression returns true if s is a Gval expression
+func IsExpression(s string) bool {
+	return s != "" && s[0] == '='
+}
+
+// CheckExpression returns an error if s is a Gval expression that
+// cannot be parsed
+func CheckExpression(s string) error {
+	if IsExpression(s) {
+		_, err := compile(s)
+		return err
+	}
+	return nil
+}
+
+// Extensions added to Gval language
+func extensions() []gval.Language {
+	return []gval.Language{
+		jsonpath.Language(), jsonpathFunction(),
+		pipeOperator(), fuzzyFunction(), formatFunction(),
+		upperFunction(), hmacSha256Function(),
+		hmacSha1Function(), dirFunction(), baseFunction(),
+		urlFunction(), timeFunctions(), encodingFunctions(),
+		collectionFunctions(), stringFunctions(), tplFunction(),
+	}
+}
+
 // Add a pipe operator to Gval expressions to pass a new Gval context to
 // another Gval expression
 func pipeOperator() gval.Language {
@@ -65,7 +143,7 @@ func pipeOperator() gval.Language {
 // evaluated json path on the json data. Data will be converted to
 // json if possible.
 func jsonpathFunction() gval.Language {
-	return gval.Function("jsonpath", func(arguments ...interface{}) (interface{}, error) {
+	return function("jsonpath", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 2 {
 			return nil, fmt.Errorf("jsonpath() expects exactly two arguments")
 		}
@@ -128,7 +206,7 @@ func toJSON(in interface{}) (map[string]interface{}, error) {
 // Add a fuzzy(string, stringList) function to Gval that returns the
 // best fuzzy match from the list
 func fuzzyFunction() gval.Language {
-	return gval.Function("fuzzy", func(arguments ...interface{}) (interface{}, error) {
+	return function("fuzzy", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 2 {
 			return nil,
 				fmt.Errorf("fuzzy() expects exactly two arguments")
@@ -177,7 +255,7 @@ func toListStrings(arg interface{}) ([]string, error) {
 
 // Add a format(string, parameters...) function to Gval
 func formatFunction() gval.Language {
-	return gval.Function("format", func(arguments ...interface{}) (interface{}, error) {
+	return function("format", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) == 0 {
 			return nil, errors.New("format() expects at least one argument")
 		}
@@ -189,23 +267,9 @@ func formatFunction() gval.Language {
 	})
 }
 
-// Add a len(list) function to Gval
-func lenFunction() gval.Language {
-	return gval.Function("len", func(arguments ...interface{}) (interface{}, error) {
-		if len(arguments) != 1 {
-			return nil, errors.New("len() expects exactly one argument")
-		}
-		l, ok := arguments[0].([]interface{})
-		if !ok {
-			return nil, errors.New("len() expects list as argument")
-		}
-		return len(l), nil
-	})
-}
-
 // Add a upper(string, parameters...) function to Gval
 func upperFunction() gval.Language {
-	return gval.Function("upper", func(arguments ...interface{}) (interface{}, error) {
+	return function("upper", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 1 {
 			return nil, errors.New("upper() expects exactly one argument")
 		}
@@ -219,7 +283,7 @@ func upperFunction() gval.Language {
 
 // Add a hmacSha256(string, parameters...) function to Gval
 func hmacSha256Function() gval.Language {
-	return gval.Function("hmacSha256", func(arguments ...interface{}) (interface{}, error) {
+	return function("hmacSha256", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 2 {
 			return nil, errors.New("hmacSha256() expects exactly two arguments")
 		}
@@ -242,7 +306,7 @@ func hmacSha256Function() gval.Language {
 
 // Add a hmacSha1(string, parameters...) function to Gval
 func hmacSha1Function() gval.Language {
-	return gval.Function("hmacSha1", func(arguments ...interface{}) (interface{}, error) {
+	return function("hmacSha1", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 2 {
 			return nil, errors.New("hmacSha1() expects exactly two arguments")
 		}
@@ -265,7 +329,7 @@ func hmacSha1Function() gval.Language {
 
 // Add a dir(string) function to Gval
 func dirFunction() gval.Language {
-	return gval.Function("dir", func(arguments ...interface{}) (interface{}, error) {
+	return function("dir", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 1 {
 			return nil, errors.New("dir() expects exactly one arguments")
 		}
@@ -280,7 +344,7 @@ func dirFunction() gval.Language {
 
 // Add a base(string) function to Gval
 func baseFunction() gval.Language {
-	return gval.Function("base", func(arguments ...interface{}) (interface{}, error) {
+	return function("base", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 1 {
 			return nil, errors.New("base() expects exactly one arguments")
 		}
@@ -295,7 +359,7 @@ func baseFunction() gval.Language {
 
 // Add a url(string) function to Gval
 func urlFunction() gval.Language {
-	return gval.Function("url", func(arguments ...interface{}) (interface{}, error) {
+	return function("url", func(arguments ...interface{}) (interface{}, error) {
 		if len(arguments) != 1 {
 			return nil, errors.New("url() expects exactly one arguments")
 		}
@@ -0,0 +1,467 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/PaesslerAG/gval"
+)
+
+// Functions added to Gval to handle lists & maps. Functions returning
+// a list or a map always return a new one.
+func collectionFunctions() gval.Language {
+	return gval.NewLanguage(
+		lenFunction(), keysFunction(), valuesFunction(),
+		containsFunction(), joinFunction(), splitFunction(),
+		sortFunction(), uniqueFunction(), firstFunction(),
+		lastFunction(), sliceFunction(), mergeFunction(),
+		pickFunction(), omitFunction(),
+	)
+}
+
+// Add a len(list|map|string) function to Gval. The length of a string
+// is its number of characters.
+func lenFunction() gval.Language {
+	return function("len", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("len() expects exactly one argument")
+		}
+		if s, ok := arguments[0].(string); ok {
+			return utf8.RuneCountInString(s), nil
+		}
+		v := reflect.ValueOf(arguments[0])
+		switch v.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return v.Len(), nil
+		}
+		return nil, errors.New("len() expects list, map or string as argument")
+	})
+}
+
+// Add a keys(map) function to Gval that returns the sorted keys of map
+func keysFunction() gval.Language {
+	return function("keys", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("keys() expects exactly one argument")
+		}
+		m, ok := toMap(arguments[0])
+		if !ok {
+			return nil, errors.New("keys() expects map as argument")
+		}
+		keys := sortedKeys(m)
+		r := make([]interface{}, len(keys))
+		for i, k := range keys {
+			r[i] = k
+		}
+		return r, nil
+	})
+}
+
+// Add a values(map) function to Gval that returns the values of map,
+// sorted by key
+func valuesFunction() gval.Language {
+	return function("values", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("values() expects exactly one argument")
+		}
+		m, ok := toMap(arguments[0])
+		if !ok {
+			return nil, errors.New("values() expects map as argument")
+		}
+		keys := sortedKeys(m)
+		r := make([]interface{}, len(keys))
+		for i, k := range keys {
+			r[i] = m[k]
+		}
+		return r, nil
+	})
+}
+
+// Add a contains(list|map|string, value) function to Gval that returns
+// true if value is an element of list, a key of map or a substring of
+// string
+func containsFunction() gval.Language {
+	return function("contains", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, errors.New("contains() expects exactly two arguments")
+		}
+		if s, ok := arguments[0].(string); ok {
+			sub, ok := arguments[1].(string)
+			if !ok {
+				return nil, errors.New("contains() expects string as second argument")
+			}
+			return strings.Contains(s, sub), nil
+		}
+		if m, ok := toMap(arguments[0]); ok {
+			_, found := m[fmt.Sprint(arguments[1])]
+			return found, nil
+		}
+		if l, ok := toList(arguments[0]); ok {
+			for _, e := range l {
+				if equal(e, arguments[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return nil, errors.New("contains() expects list, map or string as first argument")
+	})
+}
+
+// Add a join(list, separator) function to Gval that returns the
+// elements of list separated by separator
+func joinFunction() gval.Language {
+	return function("join", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, errors.New("join() expects exactly two arguments")
+		}
+		l, ok := toList(arguments[0])
+		if !ok {
+			return nil, errors.New("join() expects list as first argument")
+		}
+		sep, ok := arguments[1].(string)
+		if !ok {
+			return nil, errors.New("join() expects string as second argument")
+		}
+		s := make([]string, len(l))
+		for i, e := range l {
+			s[i] = fmt.Sprint(e)
+		}
+		return strings.Join(s, sep), nil
+	})
+}
+
+// Add a split(string, separator) function to Gval that returns the
+// list of substrings of string separated by separator
+func splitFunction() gval.Language {
+	return function("split", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, errors.New("split() expects exactly two arguments")
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("split() expects string as first argument")
+		}
+		sep, ok := arguments[1].(string)
+		if !ok {
+			return nil, errors.New("split() expects string as second argument")
+		}
+		parts := strings.Split(s, sep)
+		r := make([]interface{}, len(parts))
+		for i, p := range parts {
+			r[i] = p
+		}
+		return r, nil
+	})
+}
+
+// Add a sort(list[, key]) function to Gval. Numbers are sorted
+// numerically, other values as strings. If key is set, list must
+// contains maps that are sorted by their key value.
+func sortFunction() gval.Language {
+	return function("sort", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 && len(arguments) != 2 {
+			return nil, errors.New("sort() expects one or two arguments")
+		}
+		l, ok := toList(arguments[0])
+		if !ok {
+			return nil, errors.New("sort() expects list as first argument")
+		}
+		get := func(e interface{}) interface{} { return e }
+		if len(arguments) == 2 {
+			key, ok := arguments[1].(string)
+			if !ok {
+				return nil, errors.New("sort() expects string as second argument")
+			}
+			for _, e := range l {
+				if _, ok := toMap(e); !ok {
+					return nil, errors.New("sort() expects list of maps when key is set")
+				}
+			}
+			get = func(e interface{}) interface{} {
+				m, _ := toMap(e)
+				return m[key]
+			}
+		}
+		r := append([]interface{}{}, l...)
+		sort.SliceStable(r, func(i, j int) bool {
+			return less(get(r[i]), get(r[j]))
+		})
+		return r, nil
+	})
+}
+
+// Add a unique(list) function to Gval that returns list without
+// duplicate elements
+func uniqueFunction() gval.Language {
+	return function("unique", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("unique() expects exactly one argument")
+		}
+		l, ok := toList(arguments[0])
+		if !ok {
+			return nil, errors.New("unique() expects list as argument")
+		}
+		r := []interface{}{}
+	elements:
+		for _, e := range l {
+			for _, u := range r {
+				if equal(e, u) {
+					continue elements
+				}
+			}
+			r = append(r, e)
+		}
+		return r, nil
+	})
+}
+
+// Add a first(list) function to Gval that returns the first element
+// of list, or nil if list is empty
+func firstFunction() gval.Language {
+	return function("first", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("first() expects exactly one argument")
+		}
+		l, ok := toList(arguments[0])
+		if !ok {
+			return nil, errors.New("first() expects list as argument")
+		}
+		if len(l) == 0 {
+			return nil, nil
+		}
+		return l[0], nil
+	})
+}
+
+// Add a last(list) function to Gval that returns the last element of
+// list, or nil if list is empty
+func lastFunction() gval.Language {
+	return function("last", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("last() expects exactly one argument")
+		}
+		l, ok := toList(arguments[0])
+		if !ok {
+			return nil, errors.New("last() expects list as argument")
+		}
+		if len(l) == 0 {
+			return nil, nil
+		}
+		return l[len(l)-1], nil
+	})
+}
+
+// Add a slice(list|string, start[, end]) function to Gval that returns
+// the elements or characters from start to end (excluded). Negative
+// indexes are counted from the end. Indexes out of range are
+// truncated.
+func sliceFunction() gval.Language {
+	return function("slice", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 && len(arguments) != 3 {
+			return nil, errors.New("slice() expects two or three arguments")
+		}
+		var length int
+		s, isString := arguments[0].(string)
+		l, isList := toList(arguments[0])
+		switch {
+		case isString:
+			length = utf8.RuneCountInString(s)
+		case isList:
+			length = len(l)
+		default:
+			return nil, errors.New("slice() expects list or string as first argument")
+		}
+		start, ok := toFloat(arguments[1])
+		if !ok {
+			return nil, errors.New("slice() expects number as second argument")
+		}
+		end := float64(length)
+		if len(arguments) == 3 {
+			if end, ok = toFloat(arguments[2]); !ok {
+				return nil, errors.New("slice() expects number as third argument")
+			}
+		}
+		from, to := sliceIndex(int(start), length), sliceIndex(int(end), length)
+		if to < from {
+			to = from
+		}
+		if isString {
+			return string([]rune(s)[from:to]), nil
+		}
+		return append([]interface{}{}, l[from:to]...), nil
+	})
+}
+
+// Add a merge(map1, map2, ...) function to Gval that returns a map
+// with the keys of all maps. If a key is in several maps, the value of
+// the last one is used.
+func mergeFunction() gval.Language {
+	return function("merge", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) == 0 {
+			return nil, errors.New("merge() expects at least one argument")
+		}
+		r := make(map[string]interface{})
+		for _, a := range arguments {
+			m, ok := toMap(a)
+			if !ok {
+				return nil, errors.New("merge() expects maps as arguments")
+			}
+			for k, v := range m {
+				r[k] = v
+			}
+		}
+		return r, nil
+	})
+}
+
+// Add a pick(map, keys...) function to Gval that returns a map with
+// only the keys listed. Keys can also be passed as a list.
+func pickFunction() gval.Language {
+	return function("pick", func(arguments ...interface{}) (interface{}, error) {
+		m, keys, err := mapAndKeys("pick", arguments)
+		if err != nil {
+			return nil, err
+		}
+		r := make(map[string]interface{})
+		for _, k := range keys {
+			if v, ok := m[k]; ok {
+				r[k] = v
+			}
+		}
+		return r, nil
+	})
+}
+
+// Add a omit(map, keys...) function to Gval that returns a map without
+// the keys listed. Keys can also be passed as a list.
+func omitFunction() gval.Language {
+	return function("omit", func(arguments ...interface{}) (interface{}, error) {
+		m, keys, err := mapAndKeys("omit", arguments)
+		if err != nil {
+			return nil, err
+		}
+		r := make(map[string]interface{})
+		for k, v := range m {
+			r[k] = v
+		}
+		for _, k := range keys {
+			delete(r, k)
+		}
+		return r, nil
+	})
+}
+
+// Returns the map & the keys expected as arguments by function name
+func mapAndKeys(name string, arguments []interface{}) (map[string]interface{}, []string, error) {
+	if len(arguments) < 2 {
+		return nil, nil,
+			fmt.Errorf("%v() expects at least two arguments", name)
+	}
+	m, ok := toMap(arguments[0])
+	if !ok {
+		return nil, nil,
+			fmt.Errorf("%v() expects map as first argument", name)
+	}
+	var keys []string
+	for _, a := range arguments[1:] {
+		if l, ok := toList(a); ok {
+			for _, k := range l {
+				keys = append(keys, fmt.Sprint(k))
+			}
+		} else {
+			keys = append(keys, fmt.Sprint(a))
+		}
+	}
+	return m, keys, nil
+}
+
+// Tries to convert data to a list
+func toList(arg interface{}) ([]interface{}, bool) {
+	if l, ok := arg.([]interface{}); ok {
+		return l, true
+	}
+	v := reflect.ValueOf(arg)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, false
+	}
+	if _, ok := arg.([]byte); ok {
+		return nil, false
+	}
+	l := make([]interface{}, v.Len())
+	for i := range l {
+		l[i] = v.Index(i).Interface()
+	}
+	return l, true
+}
+
+// Tries to convert data to a map with string keys
+func toMap(arg interface{}) (map[string]interface{}, bool) {
+	if m, ok := arg.(map[string]interface{}); ok {
+		return m, true
+	}
+	v := reflect.ValueOf(arg)
+	if v.Kind() != reflect.Map {
+		return nil, false
+	}
+	m := make(map[string]interface{}, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		m[fmt.Sprint(iter.Key().Interface())] = iter.Value().Interface()
+	}
+	return m, true
+}
+
+// Returns the keys of m, sorted
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns true if a equals b. Numbers of different types are equal if
+// they have the same value.
+func equal(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Returns true if a is before b: numbers are compared numerically,
+// other values as strings
+func less(a, b interface{}) bool {
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		return fa < fb
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// Returns the index i of a list of length l, counted from the end if
+// negative, truncated to the list bounds
+func sliceIndex(i, l int) int {
+	if i < 0 {
+		i += l
+	}
+	if i < 0 {
+		return 0
+	}
+	if i > l {
+		return l
+	}
+	return i
+}
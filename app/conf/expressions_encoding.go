@@ -0,0 +1,241 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package conf
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"reflect"
+	"sort"
+
+	"github.com/PaesslerAG/gval"
+	"gopkg.in/yaml.v3"
+)
+
+// Functions added to Gval to encode, decode & hash data
+func encodingFunctions() gval.Language {
+	return gval.NewLanguage(
+		base64EncodeFunction(), base64DecodeFunction(),
+		urlEncodeFunction(), urlDecodeFunction(),
+		hashFunction("sha256", sha256.New),
+		hashFunction("sha1", sha1.New),
+		hashFunction("md5", md5.New),
+		hexFunction(), toJSONFunction(), fromJSONFunction(),
+		toYAMLFunction(), secureCompareFunction(),
+	)
+}
+
+// Add a base64Encode(string) function to Gval
+func base64EncodeFunction() gval.Language {
+	return function("base64Encode", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("base64Encode() expects exactly one argument")
+		}
+		b, ok := toBytes(arguments[0])
+		if !ok {
+			return nil, errors.New("base64Encode() expects string as argument")
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	})
+}
+
+// Add a base64Decode(string) function to Gval. Padding is optional.
+func base64DecodeFunction() gval.Language {
+	return function("base64Decode", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("base64Decode() expects exactly one argument")
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("base64Decode() expects string as argument")
+		}
+		enc := base64.StdEncoding
+		if len(s)%4 != 0 {
+			enc = base64.RawStdEncoding
+		}
+		b, err := enc.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("base64Decode() cannot decode: %v", err)
+		}
+		return string(b), nil
+	})
+}
+
+// Add a urlEncode(string|map) function to Gval. A string is escaped
+// to be put in a URL query, a map is encoded as a URL query, sorted by
+// key.
+func urlEncodeFunction() gval.Language {
+	return function("urlEncode", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("urlEncode() expects exactly one argument")
+		}
+		if s, ok := arguments[0].(string); ok {
+			return url.QueryEscape(s), nil
+		}
+		v := reflect.ValueOf(arguments[0])
+		if v.Kind() != reflect.Map {
+			return nil, errors.New("urlEncode() expects string or map as argument")
+		}
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k := fmt.Sprint(iter.Key().Interface())
+			keys = append(keys, k)
+			values[k] = iter.Value().Interface()
+		}
+		sort.Strings(keys)
+		q := url.Values{}
+		for _, k := range keys {
+			if l, ok := values[k].([]interface{}); ok {
+				for _, e := range l {
+					q.Add(k, fmt.Sprint(e))
+				}
+			} else {
+				q.Add(k, fmt.Sprint(values[k]))
+			}
+		}
+		return q.Encode(), nil
+	})
+}
+
+// Add a urlDecode(string) function to Gval
+func urlDecodeFunction() gval.Language {
+	return function("urlDecode", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("urlDecode() expects exactly one argument")
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("urlDecode() expects string as argument")
+		}
+		r, err := url.QueryUnescape(s)
+		if err != nil {
+			return nil, fmt.Errorf("urlDecode() cannot decode: %v", err)
+		}
+		return r, nil
+	})
+}
+
+// Add a name(string) function to Gval that returns the hex encoded
+// hash of string
+func hashFunction(name string, h func() hash.Hash) gval.Language {
+	return function(name, func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, fmt.Errorf("%v() expects exactly one argument", name)
+		}
+		b, ok := toBytes(arguments[0])
+		if !ok {
+			return nil, fmt.Errorf("%v() expects string as argument", name)
+		}
+		sum := h()
+		if _, err := sum.Write(b); err != nil {
+			return nil, fmt.Errorf("%v() cannot write hash", name)
+		}
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	})
+}
+
+// Add a hex(string) function to Gval
+func hexFunction() gval.Language {
+	return function("hex", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("hex() expects exactly one argument")
+		}
+		b, ok := toBytes(arguments[0])
+		if !ok {
+			return nil, errors.New("hex() expects string as argument")
+		}
+		return hex.EncodeToString(b), nil
+	})
+}
+
+// Add a toJSON(value) function to Gval that returns value encoded in
+// JSON
+func toJSONFunction() gval.Language {
+	return function("toJSON", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("toJSON() expects exactly one argument")
+		}
+		b, err := json.Marshal(arguments[0])
+		if err != nil {
+			return nil, fmt.Errorf("toJSON() cannot encode: %v", err)
+		}
+		return string(b), nil
+	})
+}
+
+// Add a fromJSON(string) function to Gval that returns the decoded
+// JSON value
+func fromJSONFunction() gval.Language {
+	return function("fromJSON", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("fromJSON() expects exactly one argument")
+		}
+		b, ok := toBytes(arguments[0])
+		if !ok {
+			return nil, errors.New("fromJSON() expects string as argument")
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("fromJSON() cannot decode: %v", err)
+		}
+		return v, nil
+	})
+}
+
+// Add a toYAML(value) function to Gval that returns value encoded in
+// YAML
+func toYAMLFunction() gval.Language {
+	return function("toYAML", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("toYAML() expects exactly one argument")
+		}
+		b, err := yaml.Marshal(arguments[0])
+		if err != nil {
+			return nil, fmt.Errorf("toYAML() cannot encode: %v", err)
+		}
+		return string(b), nil
+	})
+}
+
+// Add a secureCompare(string1, string2) function to Gval that
+// compares strings in constant time, to check signatures or tokens
+func secureCompareFunction() gval.Language {
+	return function("secureCompare", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, errors.New("secureCompare() expects exactly two arguments")
+		}
+		a, ok := toBytes(arguments[0])
+		if !ok {
+			return nil, errors.New("secureCompare() expects string as arguments")
+		}
+		b, ok := toBytes(arguments[1])
+		if !ok {
+			return nil, errors.New("secureCompare() expects string as arguments")
+		}
+		return subtle.ConstantTimeCompare(a, b) == 1, nil
+	})
+}
+
+// Tries to convert data to bytes
+func toBytes(arg interface{}) ([]byte, bool) {
+	switch s := arg.(type) {
+	case string:
+		return []byte(s), true
+	case []byte:
+		return s, true
+	}
+	return nil, false
+}
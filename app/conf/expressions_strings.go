@@ -0,0 +1,283 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PaesslerAG/gval"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Maximum length of the strings returned by padLeft() & padRight()
+const maxPadLength = 1 << 16
+
+// Maximum number of compiled regexps kept in cache
+const maxRegexps = 256
+
+// Compiled regexps used in expressions
+var regexps = newCache(maxRegexps)
+
+// Functions added to Gval to handle strings
+func stringFunctions() gval.Language {
+	return gval.NewLanguage(
+		stringFunction("lower", strings.ToLower),
+		stringFunction("title", func(s string) string {
+			return cases.Title(language.Und).String(s)
+		}),
+		stringFunction("normalize", normalize),
+		trimFunction(), replaceFunction(),
+		regexReplaceFunction(), regexFindFunction(),
+		stringTestFunction("hasPrefix", strings.HasPrefix),
+		stringTestFunction("hasSuffix", strings.HasSuffix),
+		truncateFunction(), padFunction("padLeft", true),
+		padFunction("padRight", false),
+	)
+}
+
+// Add a name(string) function to Gval that returns f(string)
+func stringFunction(name string, f func(string) string) gval.Language {
+	return function(name, func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, fmt.Errorf("%v() expects exactly one argument", name)
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%v() expects string as argument", name)
+		}
+		return f(s), nil
+	})
+}
+
+// Add a name(string1, string2) function to Gval that returns
+// f(string1, string2)
+func stringTestFunction(name string, f func(string, string) bool) gval.Language {
+	return function(name, func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, fmt.Errorf("%v() expects exactly two arguments", name)
+		}
+		s1, ok1 := arguments[0].(string)
+		s2, ok2 := arguments[1].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%v() expects string as arguments", name)
+		}
+		return f(s1, s2), nil
+	})
+}
+
+// Removes the accents & other diacritics from s
+func normalize(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)),
+		norm.NFC)
+	r, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return r
+}
+
+// Add a trim(string[, cutset]) function to Gval that removes leading
+// and trailing white spaces, or characters in cutset
+func trimFunction() gval.Language {
+	return function("trim", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 && len(arguments) != 2 {
+			return nil, errors.New("trim() expects one or two arguments")
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("trim() expects string as first argument")
+		}
+		if len(arguments) == 1 {
+			return strings.TrimSpace(s), nil
+		}
+		cutset, ok := arguments[1].(string)
+		if !ok {
+			return nil, errors.New("trim() expects string as second argument")
+		}
+		return strings.Trim(s, cutset), nil
+	})
+}
+
+// Add a replace(string, old, new) function to Gval that replaces all
+// occurrences of old by new
+func replaceFunction() gval.Language {
+	return function("replace", func(arguments ...interface{}) (interface{}, error) {
+		s, err := stringArguments("replace", arguments, 3)
+		if err != nil {
+			return nil, err
+		}
+		return strings.ReplaceAll(s[0], s[1], s[2]), nil
+	})
+}
+
+// Add a regexReplace(string, regexp, replacement) function to Gval
+// that replaces all matches of regexp by replacement, which can
+// contain $1 or ${name} to reference groups
+func regexReplaceFunction() gval.Language {
+	return function("regexReplace", func(arguments ...interface{}) (interface{}, error) {
+		s, err := stringArguments("regexReplace", arguments, 3)
+		if err != nil {
+			return nil, err
+		}
+		re, err := compileRegexp(s[1])
+		if err != nil {
+			return nil, fmt.Errorf("regexReplace() invalid regexp: %v", err)
+		}
+		return re.ReplaceAllString(s[0], s[2]), nil
+	})
+}
+
+// Add a regexFind(string, regexp[, group]) function to Gval that
+// returns the first match of regexp in string, or the value of group
+// in that match (its number or its name). Returns an empty string if
+// there is no match.
+func regexFindFunction() gval.Language {
+	return function("regexFind", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 && len(arguments) != 3 {
+			return nil, errors.New("regexFind() expects two or three arguments")
+		}
+		s, err := stringArguments("regexFind", arguments[:2], 2)
+		if err != nil {
+			return nil, err
+		}
+		re, err := compileRegexp(s[1])
+		if err != nil {
+			return nil, fmt.Errorf("regexFind() invalid regexp: %v", err)
+		}
+		group := 0
+		if len(arguments) == 3 {
+			if name, ok := arguments[2].(string); ok {
+				group = -1
+				for i, n := range re.SubexpNames() {
+					if n == name && name != "" {
+						group = i
+					}
+				}
+			} else if n, ok := toFloat(arguments[2]); ok {
+				group = int(n)
+			} else {
+				return nil, errors.New("regexFind() expects number or string as third argument")
+			}
+			if group < 0 || group > re.NumSubexp() {
+				return nil, fmt.Errorf("regexFind() unknown group %v", arguments[2])
+			}
+		}
+		m := re.FindStringSubmatch(s[0])
+		if m == nil {
+			return "", nil
+		}
+		return m[group], nil
+	})
+}
+
+// Add a truncate(string, length[, suffix]) function to Gval that keeps
+// the first length characters of string, followed by suffix if it was
+// truncated
+func truncateFunction() gval.Language {
+	return function("truncate", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 && len(arguments) != 3 {
+			return nil, errors.New("truncate() expects two or three arguments")
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("truncate() expects string as first argument")
+		}
+		n, ok := toFloat(arguments[1])
+		if !ok || n < 0 || math.IsNaN(n) {
+			return nil, errors.New("truncate() expects positive number as second argument")
+		}
+		suffix := ""
+		if len(arguments) == 3 {
+			if suffix, ok = arguments[2].(string); !ok {
+				return nil, errors.New("truncate() expects string as third argument")
+			}
+		}
+		r := []rune(s)
+		// compared before the conversion, which overflows for
+		// large numbers
+		if n >= float64(len(r)) {
+			return s, nil
+		}
+		return string(r[:int(n)]) + suffix, nil
+	})
+}
+
+// Add a name(string, length[, pad]) function to Gval that adds pad
+// (space by default) to the left or to the right of string until it
+// has length characters
+func padFunction(name string, left bool) gval.Language {
+	return function(name, func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 && len(arguments) != 3 {
+			return nil, fmt.Errorf("%v() expects two or three arguments", name)
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			s = fmt.Sprint(arguments[0])
+		}
+		n, ok := toFloat(arguments[1])
+		if !ok {
+			return nil, fmt.Errorf("%v() expects number as second argument", name)
+		}
+		if n > maxPadLength {
+			return nil, fmt.Errorf("%v() length is larger than %v",
+				name, maxPadLength)
+		}
+		pad := " "
+		if len(arguments) == 3 {
+			if pad, ok = arguments[2].(string); !ok || pad == "" {
+				return nil, fmt.Errorf("%v() expects non empty string as third argument", name)
+			}
+		}
+		missing := int(n) - utf8.RuneCountInString(s)
+		if missing <= 0 {
+			return s, nil
+		}
+		count := (missing + utf8.RuneCountInString(pad) - 1) /
+			utf8.RuneCountInString(pad)
+		padding := []rune(strings.Repeat(pad, count))[:missing]
+		if left {
+			return string(padding) + s, nil
+		}
+		return s + string(padding), nil
+	})
+}
+
+// Returns the n string arguments expected by function name
+func stringArguments(name string, arguments []interface{}, n int) ([]string, error) {
+	if len(arguments) != n {
+		return nil, fmt.Errorf("%v() expects exactly %v arguments", name, n)
+	}
+	s := make([]string, n)
+	for i, a := range arguments {
+		var ok bool
+		if s[i], ok = a.(string); !ok {
+			return nil, fmt.Errorf("%v() expects string as arguments", name)
+		}
+	}
+	return s, nil
+}
+
+// Returns the compiled regexp s, compiling it if it's not in cache yet
+func compileRegexp(s string) (*regexp.Regexp, error) {
+	if re, ok := regexps.get(s).(*regexp.Regexp); ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	regexps.add(s, re)
+	return re, nil
+}
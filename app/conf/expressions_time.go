@@ -0,0 +1,375 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+	// time zones are available without zoneinfo files, like in the
+	// Docker image
+	_ "time/tzdata"
+
+	"github.com/PaesslerAG/gval"
+)
+
+// Named layouts that can be used instead of Go layouts in
+// parseTime() & formatTime()
+var timeLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+	"TimeOnly":    "15:04:05",
+}
+
+// Functions added to Gval to handle dates & durations. Dates are
+// time.Time values; functions expecting a date also accept a RFC3339
+// string or a number of seconds since the Unix epoch. Durations are
+// numbers of seconds; functions expecting a duration also accept a
+// Go duration string like "1h30m".
+func timeFunctions() gval.Language {
+	return gval.NewLanguage(
+		nowFunction(), unixFunction(), fromUnixFunction(),
+		parseTimeFunction(), formatTimeFunction(),
+		durationFunction(), addTimeFunction(), sinceFunction(),
+		timeDiffFunction(), inZoneFunction(),
+		beforeFunction(), afterFunction(),
+		timeAccessor("year", func(t time.Time) interface{} {
+			return t.Year()
+		}),
+		timeAccessor("month", func(t time.Time) interface{} {
+			return int(t.Month())
+		}),
+		timeAccessor("day", func(t time.Time) interface{} {
+			return t.Day()
+		}),
+		timeAccessor("hour", func(t time.Time) interface{} {
+			return t.Hour()
+		}),
+		timeAccessor("minute", func(t time.Time) interface{} {
+			return t.Minute()
+		}),
+		timeAccessor("second", func(t time.Time) interface{} {
+			return t.Second()
+		}),
+		timeAccessor("weekday", func(t time.Time) interface{} {
+			return t.Weekday().String()
+		}),
+	)
+}
+
+// Add a now() function to Gval that returns the current date
+func nowFunction() gval.Language {
+	return function("now", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 0 {
+			return nil, errors.New("now() expects no argument")
+		}
+		return time.Now(), nil
+	})
+}
+
+// Add a unix([date]) function to Gval that returns the number of
+// seconds since the Unix epoch of date, or of current date
+func unixFunction() gval.Language {
+	return function("unix", func(arguments ...interface{}) (interface{}, error) {
+		switch len(arguments) {
+		case 0:
+			return time.Now().Unix(), nil
+		case 1:
+			t, err := toTime(arguments[0])
+			if err != nil {
+				return nil, fmt.Errorf("unix() expects date as argument, %v", err)
+			}
+			return t.Unix(), nil
+		}
+		return nil, errors.New("unix() expects at most one argument")
+	})
+}
+
+// Add a fromUnix(seconds) function to Gval that returns the date
+// corresponding to a number of seconds since the Unix epoch
+func fromUnixFunction() gval.Language {
+	return function("fromUnix", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("fromUnix() expects exactly one argument")
+		}
+		s, ok := toFloat(arguments[0])
+		if !ok {
+			return nil, errors.New("fromUnix() expects number as argument")
+		}
+		return fromSeconds(s), nil
+	})
+}
+
+// Add a parseTime(layout, string[, zone]) function to Gval that
+// returns the date parsed from string. layout is a Go layout or one of
+// the names in timeLayouts. If the string has no time zone, zone is
+// used, or UTC by default.
+func parseTimeFunction() gval.Language {
+	return function("parseTime", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 && len(arguments) != 3 {
+			return nil, errors.New("parseTime() expects two or three arguments")
+		}
+		layout, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("parseTime() expects string as first argument")
+		}
+		s, ok := arguments[1].(string)
+		if !ok {
+			return nil, errors.New("parseTime() expects string as second argument")
+		}
+		loc := time.UTC
+		if len(arguments) == 3 {
+			var err error
+			if loc, err = toLocation(arguments[2]); err != nil {
+				return nil, fmt.Errorf("parseTime() expects time zone as third argument, %v", err)
+			}
+		}
+		return time.ParseInLocation(toLayout(layout), s, loc)
+	})
+}
+
+// Add a formatTime(layout, date) function to Gval. layout is a Go
+// layout or one of the names in timeLayouts.
+func formatTimeFunction() gval.Language {
+	return function("formatTime", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, errors.New("formatTime() expects exactly two arguments")
+		}
+		layout, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("formatTime() expects string as first argument")
+		}
+		t, err := toTime(arguments[1])
+		if err != nil {
+			return nil, fmt.Errorf("formatTime() expects date as second argument, %v", err)
+		}
+		return t.Format(toLayout(layout)), nil
+	})
+}
+
+// Add a duration(string) function to Gval that returns the number of
+// seconds of a Go duration string like "1h30m"
+func durationFunction() gval.Language {
+	return function("duration", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("duration() expects exactly one argument")
+		}
+		d, err := toSeconds(arguments[0])
+		if err != nil {
+			return nil, fmt.Errorf("duration() expects duration as argument, %v", err)
+		}
+		return d, nil
+	})
+}
+
+// Add a addTime(date, duration) function to Gval that returns date
+// plus duration
+func addTimeFunction() gval.Language {
+	return function("addTime", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, errors.New("addTime() expects exactly two arguments")
+		}
+		t, err := toTime(arguments[0])
+		if err != nil {
+			return nil, fmt.Errorf("addTime() expects date as first argument, %v", err)
+		}
+		d, err := toSeconds(arguments[1])
+		if err != nil {
+			return nil, fmt.Errorf("addTime() expects duration as second argument, %v", err)
+		}
+		return t.Add(time.Duration(d * float64(time.Second))), nil
+	})
+}
+
+// Add a since(date) function to Gval that returns the number of
+// seconds elapsed since date
+func sinceFunction() gval.Language {
+	return function("since", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("since() expects exactly one argument")
+		}
+		t, err := toTime(arguments[0])
+		if err != nil {
+			return nil, fmt.Errorf("since() expects date as argument, %v", err)
+		}
+		return time.Since(t).Seconds(), nil
+	})
+}
+
+// Add a timeDiff(date1, date2) function to Gval that returns the
+// number of seconds between date2 and date1 (date1 - date2)
+func timeDiffFunction() gval.Language {
+	return function("timeDiff", func(arguments ...interface{}) (interface{}, error) {
+		t1, t2, err := twoTimes("timeDiff", arguments)
+		if err != nil {
+			return nil, err
+		}
+		return t1.Sub(t2).Seconds(), nil
+	})
+}
+
+// Add a inZone(date, zone) function to Gval that returns date in the
+// time zone, like "Europe/Paris", "UTC" or "Local"
+func inZoneFunction() gval.Language {
+	return function("inZone", func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 2 {
+			return nil, errors.New("inZone() expects exactly two arguments")
+		}
+		t, err := toTime(arguments[0])
+		if err != nil {
+			return nil, fmt.Errorf("inZone() expects date as first argument, %v", err)
+		}
+		loc, err := toLocation(arguments[1])
+		if err != nil {
+			return nil, fmt.Errorf("inZone() expects time zone as second argument, %v", err)
+		}
+		return t.In(loc), nil
+	})
+}
+
+// Add a before(date1, date2) function to Gval that returns true if
+// date1 is before date2
+func beforeFunction() gval.Language {
+	return function("before", func(arguments ...interface{}) (interface{}, error) {
+		t1, t2, err := twoTimes("before", arguments)
+		if err != nil {
+			return nil, err
+		}
+		return t1.Before(t2), nil
+	})
+}
+
+// Add a after(date1, date2) function to Gval that returns true if
+// date1 is after date2
+func afterFunction() gval.Language {
+	return function("after", func(arguments ...interface{}) (interface{}, error) {
+		t1, t2, err := twoTimes("after", arguments)
+		if err != nil {
+			return nil, err
+		}
+		return t1.After(t2), nil
+	})
+}
+
+// Add a name(date) function to Gval that returns the value of get on
+// date, in the time zone of date
+func timeAccessor(name string, get func(time.Time) interface{}) gval.Language {
+	return function(name, func(arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, fmt.Errorf("%v() expects exactly one argument", name)
+		}
+		t, err := toTime(arguments[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v() expects date as argument, %v", name, err)
+		}
+		return get(t), nil
+	})
+}
+
+// Returns the two dates expected as arguments by function name
+func twoTimes(name string, arguments []interface{}) (time.Time, time.Time, error) {
+	if len(arguments) != 2 {
+		return time.Time{}, time.Time{},
+			fmt.Errorf("%v() expects exactly two arguments", name)
+	}
+	t1, err := toTime(arguments[0])
+	if err != nil {
+		return time.Time{}, time.Time{},
+			fmt.Errorf("%v() expects date as first argument, %v", name, err)
+	}
+	t2, err := toTime(arguments[1])
+	if err != nil {
+		return time.Time{}, time.Time{},
+			fmt.Errorf("%v() expects date as second argument, %v", name, err)
+	}
+	return t1, t2, nil
+}
+
+// Tries to convert data to a date
+func toTime(arg interface{}) (time.Time, error) {
+	switch t := arg.(type) {
+	case time.Time:
+		return t, nil
+	case *time.Time:
+		if t != nil {
+			return *t, nil
+		}
+	case string:
+		if s, err := strconv.ParseFloat(t, 64); err == nil {
+			return fromSeconds(s), nil
+		}
+		return time.Parse(time.RFC3339Nano, t)
+	}
+	if s, ok := toFloat(arg); ok {
+		return fromSeconds(s), nil
+	}
+	return time.Time{}, fmt.Errorf("not a date: %v", arg)
+}
+
+// Tries to convert data to a number of seconds
+func toSeconds(arg interface{}) (float64, error) {
+	if s, ok := arg.(string); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		return d.Seconds(), nil
+	}
+	if s, ok := toFloat(arg); ok {
+		return s, nil
+	}
+	return 0, fmt.Errorf("not a duration: %v", arg)
+}
+
+// Tries to convert data to a time zone
+func toLocation(arg interface{}) (*time.Location, error) {
+	s, ok := arg.(string)
+	if !ok {
+		return nil, fmt.Errorf("not a string: %v", arg)
+	}
+	return time.LoadLocation(s)
+}
+
+// Tries to convert a numeric value to float
+func toFloat(arg interface{}) (float64, bool) {
+	v := reflect.ValueOf(arg)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// Returns the date of a number of seconds since the Unix epoch
+func fromSeconds(s float64) time.Time {
+	sec := math.Floor(s)
+	return time.Unix(int64(sec), int64((s-sec)*float64(time.Second)))
+}
+
+// Returns the Go layout corresponding to a layout name, or layout
+// itself
+func toLayout(layout string) string {
+	if l, ok := timeLayouts[layout]; ok {
+		return l
+	}
+	return layout
+}
@@ -11,7 +11,6 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
 )
 
@@ -19,63 +18,130 @@ type include struct {
 	Include string
 }
 
-func processInclude(cfg *yaml.Node) {
+// loader replaces 'include' statements by the content of included
+// files and collects all the problems found while doing it
+type loader struct {
+	// included files
+	files []string
+	// file each included predicate comes from
+	origins map[*yaml.Node]string
+	errs    Errors
+}
+
+func (l *loader) error(file string, n *yaml.Node, err error) {
+	l.errs = append(l.errs, nodeError(file, n, err))
+}
+
+// Replace 'include' statements in cfg, read from file
+func (l *loader) processInclude(cfg *yaml.Node, file string) {
+	if l.origins == nil {
+		l.origins = map[*yaml.Node]string{}
+	}
 	if cfg.Kind == yaml.DocumentNode && len(cfg.Content) == 1 {
-		processNode(cfg.Content[0])
+		l.processNode(cfg.Content[0], file)
 	}
 }
 
-func processNode(n *yaml.Node) {
+func (l *loader) processNode(n *yaml.Node, file string) {
 	if n.Kind != yaml.SequenceNode {
-		log.Fatal().Err(errors.
-			New("Toplevel conf & 'pipe' content must be a list")).
-			Int("line", n.Line).Msg("")
+		l.error(file, n, errors.
+			New("Toplevel conf & 'pipe' content must be a list"))
+		return
 	}
-	l := len(n.Content)
-	for i := 0; i < l; i++ {
+	for i := 0; i < len(n.Content); i++ {
 		p := n.Content[i]
+		f := file
+		if o, ok := l.origins[p]; ok {
+			f = o
+		}
 		if p.Kind != yaml.MappingNode {
-			log.Fatal().
-				Err(errors.New("Predicate must be dict")).
-				Int("line", p.Line).Msgf("")
+			l.error(f, p, errors.New("Predicate must be dict"))
+			continue
 		}
 		for j := 0; j < len(p.Content); j += 2 {
 			name := ""
 			if err := (p.Content[j]).Decode(&name); err != nil {
-				log.Fatal().Err(err).
-					Int("line", p.Content[j].Line).Msg("")
+				l.error(f, p.Content[j], err)
+				continue
 			}
 			if name == "include" {
-				nodes := readInclude(n.Content[i])
-				// Replace the 'include' by the included predicates
+				nodes, inc := l.readInclude(p, f)
+				for _, node := range nodes {
+					l.origins[node] = inc
+				}
+				// Replace the 'include' by the included
+				// predicates, which are processed next
 				n.Content = append(n.Content[:i], append(nodes,
 					n.Content[i+1:]...)...)
-				l += len(nodes) - 1
 				i--
+				break
 			}
-			if name == "pipe" {
-				processNode(p.Content[j+1])
+			switch name {
+			case "pipe", "rescue", "always", "parallel":
+				l.processNode(p.Content[j+1], f)
+			case "define":
+				if pipe := MapValue(p.Content[j+1], "pipe"); pipe != nil {
+					l.processNode(pipe, f)
+				}
 			}
 		}
 	}
 }
 
-func readInclude(node *yaml.Node) []*yaml.Node {
+// Returns the predicates in the file included by node, found in
+// file, and the name of the included file
+func (l *loader) readInclude(node *yaml.Node, file string) ([]*yaml.Node, string) {
 	inc := include{}
 	if err := node.Decode(&inc); err != nil {
-		log.Fatal().Err(err).Int("line", node.Line).Msg("Invalid 'include'")
+		l.error(file, node, fmt.Errorf("Invalid 'include': %w", err))
+		return nil, ""
+	}
+	if len(node.Content) > 2 {
+		l.error(file, node, errors.New("'include' must be used alone"))
+	}
+	l.files = append(l.files, inc.Include)
+	d, err := ReadFile(inc.Include)
+	if err != nil {
+		var errs Errors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				if e.Line == 0 {
+					// error is about the include itself
+					e.Err = fmt.Errorf("included file %v: %w",
+						e.File, e.Err)
+					e.File, e.Line, e.Column =
+						file, node.Line, node.Column
+				}
+			}
+			l.errs = append(l.errs, errs...)
+		} else {
+			l.error(file, node, err)
+		}
+		return nil, ""
 	}
-	d := ReadFile(inc.Include)
 	if d.Kind != yaml.DocumentNode || len(d.Content) != 1 {
-		log.Fatal().
-			Err(fmt.Errorf("included file %v is not a valid document",
-				inc.Include)).Msg("")
+		l.error(inc.Include, d,
+			errors.New("included file is not a valid document"))
+		return nil, ""
 	}
 	n := d.Content[0]
 	if n.Kind != yaml.SequenceNode {
-		log.Fatal().
-			Err(fmt.Errorf("included file %v must be a list", inc.Include)).
-			Msg("")
+		l.error(inc.Include, n, errors.New("included file must be a list"))
+		return nil, ""
+	}
+	return n.Content, inc.Include
+}
+
+// MapValue returns the value of key in mapping node n, nil if not
+// found
+func MapValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
 	}
-	return n.Content
+	return nil
 }
@@ -0,0 +1,133 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package conf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/jsautret/genapid/ctx"
+)
+
+// Maximum number of parsed templates kept in cache
+const maxTemplates = 256
+
+// Parsed templates, by source text
+var templates = newCache(maxTemplates)
+
+// Functions of text/template that are not replaced by the Gval
+// functions with the same name
+var templateBuiltins = map[string]bool{"len": true, "slice": true}
+
+// Data of the templates. Only the values of the ctx.Ctx are given, so
+// templates cannot call its methods that modify it.
+type templateData struct {
+	R   ctx.Registered
+	V   ctx.Variables
+	In  *http.Request
+	Req *ctx.Request
+}
+
+// RenderTemplate renders the Go text/template source with R, V, In &
+// Req of c as data. The functions available in Gval expressions can be
+// used, with a few helpers.
+func RenderTemplate(source string, c *ctx.Ctx) (string, error) {
+	t, err := parseTemplate(source)
+	if err != nil {
+		return "", err
+	}
+	data := templateData{R: c.R, V: c.V, In: c.In, Req: c.Req}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// CheckTemplate returns an error if source is not a valid template
+func CheckTemplate(source string) error {
+	_, err := parseTemplate(source)
+	return err
+}
+
+// Returns the parsed template source, parsing it if it's not in cache
+// yet
+func parseTemplate(source string) (*template.Template, error) {
+	if t, ok := templates.get(source).(*template.Template); ok {
+		return t, nil
+	}
+	t, err := template.New("template").Funcs(templateFuncs()).
+		Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	templates.add(source, t)
+	return t, nil
+}
+
+// Functions available in templates
+func templateFuncs() template.FuncMap {
+	funcs := template.FuncMap{
+		"default": templateDefault,
+		"quote": func(v interface{}) string {
+			return fmt.Sprintf("%q", fmt.Sprint(v))
+		},
+		"indent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+		},
+	}
+	for name, f := range functions {
+		if !templateBuiltins[name] {
+			funcs[name] = f
+		}
+	}
+	return funcs
+}
+
+// Returns value, or def if value is not set or empty. It is meant to
+// be used in pipelines: {{ .V.name | default "unknown" }}
+func templateDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || value[0] == nil {
+		return def
+	}
+	v := reflect.ValueOf(value[0])
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return def
+		}
+	}
+	return value[0]
+}
+
+// Add a tpl(template) function to Gval that renders the Go
+// text/template with the current R, V, In & Req
+func tplFunction() gval.Language {
+	return gval.Function("tpl", func(gc context.Context, arguments ...interface{}) (interface{}, error) {
+		if len(arguments) != 1 {
+			return nil, errors.New("tpl() expects exactly one argument")
+		}
+		s, ok := arguments[0].(string)
+		if !ok {
+			return nil, errors.New("tpl() expects string as argument")
+		}
+		c, ok := gc.Value(ctxKey{}).(*ctx.Ctx)
+		if !ok {
+			return nil, errors.New("tpl() cannot be used here")
+		}
+		r, err := RenderTemplate(s, c)
+		if err != nil {
+			return nil, fmt.Errorf("tpl() cannot render: %v", err)
+		}
+		return r, nil
+	})
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+// +build !disable_response
+
+package plugins
+
+import responsepredicate "github.com/jsautret/genapid/predicates/response"
+
+func init() {
+	Add(responsepredicate.Name, responsepredicate.New)
+}
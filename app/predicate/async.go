@@ -0,0 +1,155 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Size of the pool used when StartAsync was not called
+const (
+	defaultAsyncWorkers = 4
+	defaultAsyncQueue   = 100
+)
+
+var (
+	// Evaluates the predicates with the 'async' option
+	pool *workerPool
+	// Protects pool
+	poolLock sync.Mutex
+)
+
+// StartAsync starts workers goroutines to evaluate the predicates
+// and pipes set with the 'async' option. Up to queue of them can wait
+// for a worker, the following ones fail.
+func StartAsync(workers, queue int) {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	pool = newWorkerPool(workers, queue)
+}
+
+// WaitAsync waits until all the async predicates & pipes are
+// evaluated. The ones started afterwards fail.
+func WaitAsync() {
+	poolLock.Lock()
+	p := pool
+	poolLock.Unlock()
+	if p != nil {
+		p.wait()
+	}
+}
+
+// Returns the current pool, starting one if needed
+func asyncPool() *workerPool {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	if pool == nil {
+		pool = newWorkerPool(defaultAsyncWorkers, defaultAsyncQueue)
+	}
+	return pool
+}
+
+func assignAsync(o *pOptions, n yaml.Node) error {
+	if err := n.Decode(&o.async); err != nil {
+		return fmt.Errorf("invalid 'async': %w", err)
+	}
+	return nil
+}
+
+// Evaluate the predicate or pipe set in o in background, with a copy
+// of c. It is not cancelled when the request is done, and its
+// 'response' is ignored. Returns an error if it cannot be queued.
+func processAsync(log zerolog.Logger, o *pOptions, cfg *conf.Predicate, c *ctx.Ctx) (bool, error) {
+	ac := c.ForkRequest()
+	ac.SetContext(context.Background())
+	ac.Response = nil
+	ao := *o
+	ao.async = false
+	log = log.With().Bool("async", true).Logger()
+	err := asyncPool().submit(func() {
+		log.Debug().Msg("Start async")
+		result, _ := process(log, &ao, cfg, ac)
+		log.Info().Bool("value", result).Msg("Async done")
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		return false, err
+	}
+	log.Debug().Msg("Async queued")
+	return true, nil
+}
+
+// workerPool runs jobs in a fixed number of goroutines
+type workerPool struct {
+	jobs chan func()
+	// queued & running jobs
+	wg sync.WaitGroup
+	// protects jobs & closed
+	lock   sync.Mutex
+	closed bool
+}
+
+func newWorkerPool(workers, queue int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *workerPool) worker() {
+	for job := range p.jobs {
+		p.run(job)
+	}
+}
+
+// Run job, without letting a panic kill the daemon
+func (p *workerPool) run(job func()) {
+	defer p.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("Async panic: %v", r)
+		}
+	}()
+	job()
+}
+
+// Queue job, or returns an error if the queue is full or the pool is
+// closed
+func (p *workerPool) submit(job func()) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return errors.New("Async predicates are stopped")
+	}
+	p.wg.Add(1)
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		p.wg.Done()
+		return errors.New("Too many async predicates are waiting")
+	}
+}
+
+// Stop accepting jobs & wait for the queued ones
+func (p *workerPool) wait() {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.lock.Unlock()
+	p.wg.Wait()
+}
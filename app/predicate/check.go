@@ -0,0 +1,140 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/app/plugins"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Check returns the problems found in the predicate or pipe set in
+// node n of cfg, read from file, without evaluating it
+func Check(cfg *conf.Config, n *yaml.Node, file string) conf.Errors {
+	var errs conf.Errors
+	add := func(n *yaml.Node, err error) {
+		errs = append(errs, &conf.Error{
+			File: file, Line: n.Line, Column: n.Column, Err: err,
+		})
+	}
+	if n.Kind != yaml.MappingNode {
+		add(n, errors.New("Predicate must be dict"))
+		return errs
+	}
+	p := conf.Predicate{}
+	if err := n.Decode(&p); err != nil {
+		add(n, err)
+		return errs
+	}
+	o, err := getOptions(log.Logger, &p)
+	if err != nil {
+		add(n, err)
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		switch {
+		case key.Value == "pipe" || key.Value == "rescue" ||
+			key.Value == "always" || key.Value == "parallel":
+			if value.Kind != yaml.SequenceNode {
+				// already reported by getOptions
+				continue
+			}
+			for _, c := range value.Content {
+				errs = append(errs,
+					CheckNested(cfg, c, cfg.FileOf(c, file))...)
+			}
+			continue
+		case key.Value == "default" && value.Kind == yaml.MappingNode:
+			for j := 0; j < len(value.Content); j += 2 {
+				if name := value.Content[j]; plugins.Get(name.Value) == nil {
+					add(name, fmt.Errorf("Unknown predicate '%v' in 'default'",
+						name.Value))
+				}
+			}
+		case o != nil && o.call != nil && key.Value == "call":
+			if definedNames(cfg)[o.call.name] == 0 {
+				add(value, fmt.Errorf("Unknown pipe '%v' in 'call'",
+					o.call.name))
+			}
+		case o != nil && o.p != nil && key.Value == o.p.Name():
+			var perrs conf.Errors
+			for _, err := range checkParams(o.p, value) {
+				e := &conf.Error{File: file, Err: err}
+				var perr *genapid.ParamError
+				if errors.As(err, &perr) {
+					e.Line, e.Column = paramPosition(value, perr.Param)
+				}
+				if e.Line == 0 {
+					e.Line, e.Column = value.Line, value.Column
+				}
+				perrs = append(perrs, e)
+			}
+			sort.SliceStable(perrs, func(i, j int) bool {
+				if perrs[i].Line != perrs[j].Line {
+					return perrs[i].Line < perrs[j].Line
+				}
+				return perrs[i].Column < perrs[j].Column
+			})
+			errs = append(errs, perrs...)
+		}
+		errs = append(errs, checkExpressions(value, file)...)
+	}
+	return errs
+}
+
+// CheckNested is Check for a predicate or pipe that is not in the
+// top-level list of the conf
+func CheckNested(cfg *conf.Config, n *yaml.Node, file string) conf.Errors {
+	errs := Check(cfg, n, file)
+	if r := conf.MapValue(n, "route"); r != nil {
+		errs = append(errs, &conf.Error{
+			File: file, Line: r.Line, Column: r.Column, Err: errNestedRoute,
+		})
+	}
+	return errs
+}
+
+// Decode & validate parameters of predicate p set in node n
+func checkParams(p genapid.Predicate, n *yaml.Node) []error {
+	args := conf.Params{Name: p.Name()}
+	if err := n.Decode(&(args.Conf)); err != nil {
+		return []error{fmt.Errorf("Parameters for %v must be a dict",
+			p.Name())}
+	}
+	return genapid.CheckPredicate(p, &args)
+}
+
+// Returns position of parameter param in node n
+func paramPosition(n *yaml.Node, param string) (int, int) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == param {
+			return n.Content[i].Line, n.Content[i].Column
+		}
+	}
+	return 0, 0
+}
+
+// Returns Gval expressions found in n that cannot be parsed
+func checkExpressions(n *yaml.Node, file string) conf.Errors {
+	var errs conf.Errors
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" {
+		if err := conf.CheckExpression(n.Value); err != nil {
+			errs = append(errs, &conf.Error{
+				File: file, Line: n.Line, Column: n.Column,
+				Err: fmt.Errorf("invalid expression: %w", err),
+			})
+		}
+	}
+	for _, c := range n.Content {
+		errs = append(errs, checkExpressions(c, file)...)
+	}
+	return errs
+}
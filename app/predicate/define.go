@@ -0,0 +1,264 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// Maximum number of nested 'call', to stop infinite recursions
+const maxCallDepth = 32
+
+// Key of the number of nested 'call' in context.Context
+type callDepthKey struct{}
+
+// definition is a pipe set with 'define'
+type definition struct {
+	name string
+	// parameters & their default values
+	params map[string]interface{}
+	// parameters without default value
+	required []string
+	pipe     []conf.Predicate
+	// value of 'return', may contain expressions
+	ret interface{}
+}
+
+// callArgs are the parameters of the 'call' predicate
+type callArgs struct {
+	name string
+	args map[string]interface{}
+}
+
+// Define removes the 'define' statements from the top level of cfg
+// and stores the pipes they define in c, so they can be evaluated by
+// the 'call' predicate
+func Define(log zerolog.Logger, cfg *conf.Root, c *ctx.Ctx) {
+	c.Defined = map[string]interface{}{}
+	root := conf.Root{}
+	for _, p := range *cfg {
+		n, ok := p["define"]
+		if !ok {
+			root = append(root, p)
+			continue
+		}
+		if len(p) > 1 {
+			log.Error().Err(errors.New("'define' must be used alone")).Msg("")
+			continue
+		}
+		d, err := parseDefinition(&n)
+		if err != nil {
+			log.Error().Err(err).Msg("")
+			continue
+		}
+		if _, ok := c.Defined[d.name]; ok {
+			log.Error().Err(fmt.Errorf("'%v' is defined several times",
+				d.name)).Msg("")
+			continue
+		}
+		log.Debug().Str("define", d.name).Msg("Pipe defined")
+		c.Defined[d.name] = d
+	}
+	*cfg = root
+}
+
+// Decode the content of a 'define' statement
+func parseDefinition(n *yaml.Node) (*definition, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, errors.New("'define' must be a dict")
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		switch k := n.Content[i].Value; k {
+		case "name", "params", "pipe", "return":
+		default:
+			return nil, fmt.Errorf("unknown field '%v' in 'define'", k)
+		}
+	}
+	var args struct {
+		Name   string
+		Params yaml.Node
+		Pipe   []conf.Predicate
+		Return interface{}
+	}
+	if err := n.Decode(&args); err != nil {
+		return nil, fmt.Errorf("invalid 'define': %w", err)
+	}
+	if args.Name == "" {
+		return nil, errors.New("'define' must have a name")
+	}
+	if args.Pipe == nil {
+		return nil, fmt.Errorf("'define' %v must have a pipe", args.Name)
+	}
+	d := &definition{
+		name:   args.Name,
+		params: map[string]interface{}{},
+		pipe:   args.Pipe,
+		ret:    args.Return,
+	}
+	switch args.Params.Kind {
+	case 0:
+	case yaml.SequenceNode:
+		// only names, all required
+		var names []string
+		if err := args.Params.Decode(&names); err != nil {
+			return nil, fmt.Errorf("invalid 'params' for %v: %w",
+				args.Name, err)
+		}
+		for _, p := range names {
+			d.params[p] = nil
+		}
+	case yaml.MappingNode:
+		// names & default values
+		if err := args.Params.Decode(&d.params); err != nil {
+			return nil, fmt.Errorf("invalid 'params' for %v: %w",
+				args.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("'params' of %v must be a list or a dict",
+			args.Name)
+	}
+	for p, v := range d.params {
+		if v == nil {
+			d.required = append(d.required, p)
+		}
+	}
+	sort.Strings(d.required)
+	return d, nil
+}
+
+func assignCall(o *pOptions, n yaml.Node) error {
+	if o.hasPredicate() {
+		return errors.New("'call' declared with another predicate")
+	}
+	var args struct {
+		Name string
+		Args map[string]interface{}
+	}
+	if err := n.Decode(&args); err != nil {
+		return fmt.Errorf("invalid 'call': %w", err)
+	}
+	if args.Name == "" {
+		return errors.New("'call' must have a name")
+	}
+	o.call = &callArgs{name: args.Name, args: args.Args}
+	return nil
+}
+
+// Evaluate the pipe defined with the name set in the 'call' predicate
+// of o. The arguments are evaluated in c, then the pipe is evaluated
+// with its own context, where V contains only its parameters and R is
+// empty. The value of its 'return' is stored in o.
+func processCall(log zerolog.Logger, o *pOptions, c *ctx.Ctx) (bool, error) {
+	name := o.call.name
+	log = log.With().Str("call", name).Logger()
+	o.returned = nil
+	d, ok := c.Defined[name].(*definition)
+	if !ok {
+		return false, fmt.Errorf("Unknown pipe '%v' in 'call'", name)
+	}
+	depth, _ := c.Context().Value(callDepthKey{}).(int)
+	if depth >= maxCallDepth {
+		return false, fmt.Errorf("More than %v nested 'call'", maxCallDepth)
+	}
+
+	args := map[string]interface{}{}
+	for k, v := range d.params {
+		if v != nil {
+			args[k] = v
+		}
+	}
+	for k, v := range o.call.args {
+		if _, ok := d.params[k]; !ok {
+			return false, fmt.Errorf("Unknown parameter '%v' for '%v'",
+				k, name)
+		}
+		args[k] = v
+	}
+	for _, k := range d.required {
+		if _, ok := args[k]; !ok {
+			return false, fmt.Errorf("Missing parameter '%v' for '%v'",
+				k, name)
+		}
+	}
+	values := map[string]interface{}{}
+	if err := conf.DecodeParams(c, args, &values); err != nil {
+		return false, fmt.Errorf("Invalid parameters for '%v': %w", name, err)
+	}
+
+	fc := c.Fork()
+	fc.V = ctx.Variables(values)
+	fc.R = ctx.Registered{}
+	fc.Item, fc.Index, fc.Failed = nil, 0, nil
+	fc.SetContext(context.WithValue(c.Context(), callDepthKey{}, depth+1))
+	log.Debug().Msgf("Calling '%v'", name)
+	result := ProcessPipe(log, &conf.Pipe{Name: name, Pipe: d.pipe}, fc)
+	c.Response, c.Stopped = fc.Response, fc.Stopped
+
+	if result && d.ret != nil {
+		r := map[string]interface{}{}
+		err := conf.DecodeParams(fc, map[string]interface{}{"return": d.ret}, &r)
+		if err != nil {
+			return false, fmt.Errorf("Invalid 'return' for '%v': %w", name, err)
+		}
+		o.returned = r["return"]
+	}
+	return result, nil
+}
+
+// CheckDefine returns the problems found in the 'define' statement set
+// in node n of cfg, read from file, and in the pipe it defines
+func CheckDefine(cfg *conf.Config, n *yaml.Node, file string) conf.Errors {
+	var errs conf.Errors
+	add := func(n *yaml.Node, err error) {
+		errs = append(errs, &conf.Error{
+			File: file, Line: n.Line, Column: n.Column, Err: err,
+		})
+	}
+	if len(n.Content) > 2 {
+		add(n, errors.New("'define' must be used alone"))
+	}
+	def := conf.MapValue(n, "define")
+	d, err := parseDefinition(def)
+	if err != nil {
+		add(def, err)
+		return errs
+	}
+	if definedNames(cfg)[d.name] > 1 {
+		add(def, fmt.Errorf("'%v' is defined several times", d.name))
+	}
+	for i := 0; i+1 < len(def.Content); i += 2 {
+		if value := def.Content[i+1]; def.Content[i].Value == "pipe" {
+			for _, p := range value.Content {
+				errs = append(errs, CheckNested(cfg, p, cfg.FileOf(p, file))...)
+			}
+		} else {
+			errs = append(errs, checkExpressions(value, file)...)
+		}
+	}
+	return errs
+}
+
+// Returns how many times each name is set with 'define' in cfg
+func definedNames(cfg *conf.Config) map[string]int {
+	names := map[string]int{}
+	for _, p := range cfg.Root {
+		n, ok := p["define"]
+		if !ok {
+			continue
+		}
+		if d, err := parseDefinition(&n); err == nil {
+			names[d.name]++
+		}
+	}
+	return names
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/app/plugins"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// Store the list set by 'loop' option, a list or an expression
+func assignLoop(o *pOptions, n yaml.Node) error {
+	var l interface{}
+	if err := n.Decode(&l); err != nil {
+		return fmt.Errorf("invalid 'loop': %w", err)
+	}
+	if l == nil {
+		return errors.New("'loop' must be a list or an expression")
+	}
+	o.loop = l
+	return nil
+}
+
+func assignLoopBreak(o *pOptions, n yaml.Node) error {
+	if err := n.Decode(&o.loopBreak); err != nil {
+		return fmt.Errorf("invalid 'loop_break': %w", err)
+	}
+	return nil
+}
+
+// Evaluate the predicate or pipe for each element of the 'loop'
+// option. The result is true if all the evaluations are true. If
+// 'loop_break' is set, the loop stops at the first false evaluation.
+func processLoop(log zerolog.Logger, o *pOptions, cfg *conf.Predicate, c *ctx.Ctx) (bool, error) {
+	items, err := loopItems(c, o.loop)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		return false, err
+	}
+	log.Debug().Int("items", len(items)).Msg("Start loop")
+
+	// restore current item when nested in another loop
+	item, index := c.Item, c.Index
+	defer func() { c.Item, c.Index = item, index }()
+
+	result := true
+	var loopErr error // first error in the loop
+	results := []interface{}{}
+	for i, it := range items {
+		c.Item, c.Index = it, i
+		log := log.With().Int("index", i).Logger()
+		io := *o
+		if o.p != nil {
+			// params must not be kept between iterations
+			io.p = plugins.Get(o.p.Name())
+		}
+		r, evaluated, err := evaluate(log, &io, cfg, c)
+		if err != nil && loopErr == nil {
+			loopErr = err
+		}
+		if (io.p != nil || io.call != nil) && o.register != "" {
+			res := ctx.Result{"result": r, "error": "",
+				"skipped": !evaluated}
+			if evaluated {
+				res = io.results(log, r, err)
+			}
+			results = append(results, res)
+		}
+		log.Debug().Bool("value", r).Msg("End iteration")
+		if !r {
+			result = false
+			if o.loopBreak {
+				break
+			}
+		}
+		if c.Stopped {
+			log.Debug().Msg("Loop stopped")
+			break
+		}
+	}
+	c.Item, c.Index = item, index
+
+	if len(o.variable) > 0 || len(o.def) > 0 {
+		return result, loopErr
+	}
+	if o.pipe.Pipe != nil {
+		// Always continue after a pipe, unless 'result' option is set
+		// and evaluate to false
+		return resultOption(log, o, c, true), nil
+	}
+	if o.register != "" {
+		register(log, o, c, ctx.Result{"result": result,
+			"error": errorMessage(loopErr), "results": results})
+	}
+	return resultOption(log, o, c, result), loopErr
+}
+
+// Returns the list of elements to iterate on. The elements of a map
+// are {"key": key, "value": value} maps, sorted by key.
+func loopItems(c *ctx.Ctx, loop interface{}) ([]interface{}, error) {
+	values := map[string]interface{}{}
+	if !conf.GetParams(c, map[string]interface{}{"loop": loop}, &values) {
+		return nil, errors.New("invalid 'loop'")
+	}
+	l := values["loop"]
+	v := reflect.ValueOf(l)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).Interface()
+		}
+		return items, nil
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) <
+				fmt.Sprint(keys[j].Interface())
+		})
+		items := make([]interface{}, len(keys))
+		for i, k := range keys {
+			items[i] = map[string]interface{}{
+				"key": k.Interface(), "value": v.MapIndex(k).Interface(),
+			}
+		}
+		return items, nil
+	case reflect.Invalid:
+		return []interface{}{}, nil
+	}
+	return nil, fmt.Errorf("'loop' must be a list or a map, not %v", l)
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Number of evaluations of each predicate plugin, published by expvar
+// as "predicates": {"http": {"calls": 3, "true": 1, "false": 1,
+// "errors": 1}, ...}
+var metrics = expvar.NewMap("predicates")
+
+// Protects the creation of the map of a predicate in metrics
+var metricsLock sync.Mutex
+
+// Count an evaluation of predicate name in metrics
+func count(name string, result bool, err error) {
+	m := predicateMetrics(name)
+	m.Add("calls", 1)
+	switch {
+	case err != nil:
+		m.Add("errors", 1)
+	case result:
+		m.Add("true", 1)
+	default:
+		m.Add("false", 1)
+	}
+}
+
+// Returns the metrics of predicate name, creating them if needed
+func predicateMetrics(name string) *expvar.Map {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if m, ok := metrics.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	metrics.Set(name, m)
+	return m
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+func assignParallel(o *pOptions, n yaml.Node) error {
+	if o.parallel != nil {
+		return errors.New("Several 'parallel' declared")
+	}
+	if o.hasPredicate() {
+		return errors.New("'parallel' declared with another predicate")
+	}
+	p := []conf.Predicate{}
+	if err := n.Decode(&p); err != nil {
+		return fmt.Errorf("invalid 'parallel': %w", err)
+	}
+	o.parallel = p
+	return nil
+}
+
+func assignLimit(o *pOptions, n yaml.Node) error {
+	if err := n.Decode(&o.limit); err != nil {
+		return fmt.Errorf("invalid 'limit': %w", err)
+	}
+	if o.limit < 0 {
+		return errors.New("'limit' must be positive")
+	}
+	return nil
+}
+
+func assignRequire(o *pOptions, n yaml.Node) error {
+	if err := assignOption("require", &o.require, n); err != nil {
+		return err
+	}
+	if o.require != "all" && o.require != "any" {
+		return errors.New("'require' must be 'all' or 'any'")
+	}
+	return nil
+}
+
+// Evaluate concurrently the branches of the 'parallel' block set in o,
+// at most 'limit' at the same time if it is set. Each branch is
+// evaluated with its own copy of c and of the request, then the results it registered
+// and the variables it set are merged back in c, in the order of the
+// branches. The result is true if all the branches are true, or if
+// one of them is true when 'require' is 'any'.
+func processParallel(log zerolog.Logger, o *pOptions, c *ctx.Ctx) bool {
+	log = log.With().Str("parallel", o.name).Logger()
+	log.Debug().Int("branches", len(o.parallel)).Msg("Start parallel")
+
+	forks := make([]*ctx.Ctx, len(o.parallel))
+	results := make([]bool, len(o.parallel))
+	var sem chan bool
+	if o.limit > 0 {
+		sem = make(chan bool, o.limit)
+	}
+	// the forks read the body of the request before the branches start
+	for i := range forks {
+		forks[i] = c.ForkRequest()
+	}
+	var wg sync.WaitGroup
+	for i := range o.parallel {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if sem != nil {
+				sem <- true
+				defer func() { <-sem }()
+			}
+			log := log.With().Int("branch", i).Logger()
+			// a panic would kill the daemon, the branch is
+			// false instead
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error().Msgf("Parallel panic: %v", r)
+				}
+			}()
+			results[i] = Process(log, &o.parallel[i], forks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	merged := c.Fork() // values before the branches
+	trueCount := 0
+	for i, f := range forks {
+		for k, v := range f.R {
+			if old, ok := merged.R[k]; !ok || !reflect.DeepEqual(old, v) {
+				c.R[k] = v
+			}
+		}
+		for k, v := range f.V {
+			if old, ok := merged.V[k]; !ok || !reflect.DeepEqual(old, v) {
+				c.V[k] = v
+			}
+		}
+		if c.Response == nil {
+			c.Response = f.Response
+		}
+		c.Stopped = c.Stopped || f.Stopped
+		if results[i] {
+			trueCount++
+		}
+	}
+
+	result := trueCount == len(forks)
+	if o.require == "any" {
+		result = trueCount > 0
+	}
+	log.Debug().Bool("value", result).Int("true", trueCount).
+		Msg("End parallel")
+	return result
+}
@@ -18,11 +18,11 @@ func ProcessPipe(log zerolog.Logger, p *conf.Pipe, c *ctx.Ctx) bool {
 	log.Debug().Msgf("Processing pipe '%v'", name)
 
 	// save defaults
-	d := copyDefault(c.Default)
+	d := c.Default.Copy()
 	var result bool
 	for j := 0; j < len(p.Pipe); j++ {
 		result = Process(log, &p.Pipe[j], c)
-		if !result {
+		if !result || c.Stopped {
 			break
 		}
 
@@ -34,16 +34,3 @@ func ProcessPipe(log zerolog.Logger, p *conf.Pipe, c *ctx.Ctx) bool {
 	// used for tests
 	return result
 }
-
-func copyDefault(d ctx.Default) ctx.Default {
-	n1 := ctx.Default{}
-	for k1, v1 := range d {
-		n2 := ctx.DefaultParams{}
-		for k2, v2 := range v1 {
-			n2[k2] = v2
-		}
-		n1[k1] = n2
-	}
-
-	return n1
-}
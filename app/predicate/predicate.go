@@ -19,173 +19,367 @@ import (
 
 type pOptions struct {
 	register, name, result, when string
+	route                        string
+	timeout                      string
+	retry                        *retryOptions
+	async                        bool
+	parallel                     []conf.Predicate
+	limit                        int
+	require                      string
+	call                         *callArgs
+	returned                     interface{} // value returned by 'call'
+	pipeResult                   bool        // result of the pipe before 'result'
 	p                            genapid.Predicate
 	pipe                         conf.Pipe
 	variable                     []map[string]interface{}
 	def                          ctx.DefaultParams
+	loop                         interface{}
+	loopBreak                    bool
+	rescue, always               conf.Pipe
 }
 
 func (o pOptions) hasPredicate() bool {
-	return o.p != nil || o.pipe.Pipe != nil ||
-		len(o.variable) != 0 || len(o.def) != 0
+	return o.p != nil || o.pipe.Pipe != nil || o.parallel != nil ||
+		o.call != nil || len(o.variable) != 0 || len(o.def) != 0
+}
+
+// Returns the type of predicate set in o
+func (o pOptions) kind() string {
+	switch {
+	case o.p != nil:
+		return o.p.Name()
+	case o.pipe.Pipe != nil:
+		return "pipe"
+	case o.parallel != nil:
+		return "parallel"
+	case o.call != nil:
+		return "call"
+	case len(o.variable) != 0:
+		return "variable"
+	case len(o.def) != 0:
+		return "default"
+	}
+	return ""
 }
 
 // Read all options and predicate or pipe
-func getOptions(log zerolog.Logger, cfg *conf.Predicate, c *ctx.Ctx) (*pOptions, bool) {
+func getOptions(log zerolog.Logger, cfg *conf.Predicate) (*pOptions, error) {
 	var o pOptions
 	for k, node := range *cfg {
 		log.Trace().Str("key", k).Msgf("Found Key %v for predicate", k)
+		var err error
 		switch k {
 		case "register":
-			if !assignOption(log, "register", &o.register, node) {
-				return nil, false
-			}
+			err = assignOption("register", &o.register, node)
 		case "result":
-			if !assignOption(log, "result", &o.result, node) {
-				return nil, false
-			}
+			err = assignOption("result", &o.result, node)
 		case "name":
-			if !assignOption(log, "name", &o.name, node) {
-				return nil, false
-			}
+			err = assignOption("name", &o.name, node)
 		case "when":
-			if !assignOption(log, "when", &o.when, node) {
-				return nil, false
-			}
+			err = assignOption("when", &o.when, node)
+		case "route":
+			err = assignRoute(&o, node)
+		case "timeout":
+			err = assignTimeout(&o, node)
+		case "retry":
+			err = assignRetry(&o, node)
+		case "async":
+			err = assignAsync(&o, node)
+		case "parallel":
+			err = assignParallel(&o, node)
+		case "limit":
+			err = assignLimit(&o, node)
+		case "require":
+			err = assignRequire(&o, node)
+		case "loop":
+			err = assignLoop(&o, node)
+		case "loop_break":
+			err = assignLoopBreak(&o, node)
 		case "variable":
-			if !assignVariable(log, &o, node) {
-				return nil, false
-			}
+			err = assignVariable(&o, node)
 		case "default":
-			if !assignDefault(log, &o, node) {
-				return nil, false
-			}
+			err = assignDefault(&o, node)
+		case "call":
+			err = assignCall(&o, node)
 		case "pipe":
-			if !assignPipe(log, &o, node) {
-				return nil, false
-			}
+			err = assignPipe(&o, node)
+		case "rescue":
+			err = assignSection("rescue", &o.rescue, node)
+		case "always":
+			err = assignSection("always", &o.always, node)
 		default:
 			// Try to check if it is a predicate
-			if !assignPlugin(log, &o, k) {
-				return nil, false
-			}
+			err = assignPlugin(&o, k)
 		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.pipe.Pipe == nil && o.route != "" {
+		return nil, errors.New("'route' can only be set on a pipe")
+	}
+	if o.pipe.Pipe == nil && (o.rescue.Pipe != nil || o.always.Pipe != nil) {
+		return nil, errors.New("'rescue' & 'always' can only be set on a pipe")
+	}
+	if o.p == nil && o.timeout != "" {
+		return nil, errors.New("'timeout' can only be set on a predicate")
+	}
+	if o.p == nil && o.retry != nil {
+		return nil, errors.New("'retry' can only be set on a predicate")
+	}
+	if o.retry != nil && o.retry.until != "" && o.register == "" {
+		return nil, errors.New("'retry' until requires 'register'")
 	}
-	return &o, true
+	if o.parallel == nil && (o.limit != 0 || o.require != "") {
+		return nil, errors.New("'limit' & 'require' can only be set on 'parallel'")
+	}
+	if o.parallel != nil && o.register != "" {
+		return nil, errors.New("Cannot set 'register' option on 'parallel'")
+	}
+	if o.async && o.register != "" {
+		return nil, errors.New("'register' cannot be set with 'async'")
+	}
+	return &o, nil
 }
 
 // Process evaluate a predicate or a pipe from from conf file and
 // current context
 func Process(log zerolog.Logger, cfg *conf.Predicate, c *ctx.Ctx) bool {
-	o, ok := getOptions(log, cfg, c)
-	if !ok {
-		return false
+	result, _ := processTop(log, cfg, c, false)
+	return result
+}
+
+// ProcessRoute is Process for the top-level predicates of the
+// conf. matched is true if cfg is a pipe whose predicates were all
+// true, i.e. the request was handled by it.
+func ProcessRoute(log zerolog.Logger, cfg *conf.Predicate, c *ctx.Ctx) (result, matched bool) {
+	return processTop(log, cfg, c, true)
+}
+
+// Evaluate cfg, a top-level predicate of the conf if top is true
+func processTop(log zerolog.Logger, cfg *conf.Predicate, c *ctx.Ctx, top bool) (result, matched bool) {
+	o, err := getOptions(log, cfg)
+	if err == nil && !top && o.route != "" {
+		err = errNestedRoute
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		c.Failed = &ctx.Failure{Error: err.Error()}
+		return false, false
+	}
+	if result, err := process(log, o, cfg, c); !result {
+		msg := fmt.Sprintf("'%v' is false", o.kind())
+		if err != nil {
+			msg = err.Error()
+		}
+		c.Failed = &ctx.Failure{
+			Predicate: o.kind(),
+			Name:      o.name,
+			Error:     msg,
+		}
+		return false, false
+	}
+	return true, o.pipeResult
+}
+
+// Evaluate the predicate or pipe set in o, with its options. err is
+// set if the predicate failed with an error.
+func process(log zerolog.Logger, o *pOptions, cfg *conf.Predicate, c *ctx.Ctx) (bool, error) {
+	if o.pipe.Pipe != nil {
+		log = log.With().Str("pipe", o.name).Logger()
+		if o.register != "" {
+			err := errors.New("Cannot set 'register' option on a pipe")
+			log.Error().Err(err).Msg("")
+			return false, err
+		}
+	} else if o.p != nil {
+		log = log.With().Str("predicate", o.p.Name()).
+			Str("name", o.name).Logger()
+	}
+	if o.async {
+		return processAsync(log, o, cfg, c)
+	}
+	if o.loop != nil {
+		return processLoop(log, o, cfg, c)
+	}
+
+	result, evaluated, err := evaluate(log, o, cfg, c)
+	if !evaluated || len(o.variable) > 0 || len(o.def) > 0 {
+		return result, err
 	}
-	var when bool
+	if o.pipe.Pipe != nil {
+		// Always continue after a pipe, unless 'result' option is set
+		// and evaluate to false
+		o.pipeResult, result = result, true
+	} else if o.register != "" {
+		register(log, o, c, o.results(log, result, err))
+	}
+	return resultOption(log, o, c, result), err
+}
+
+// Evaluate the predicate or pipe set in o, or the 'variable' or
+// 'default' special predicates. evaluated is false if it was not
+// evaluated because 'when' is false. err is set if the predicate
+// failed with an error.
+func evaluate(log zerolog.Logger, o *pOptions, cfg *conf.Predicate,
+	c *ctx.Ctx) (result bool, evaluated bool, err error) {
 	if o.when != "" {
+		var when bool
 		if !conf.GetParams(c, o.when, &when) {
 			log.Warn().Err(errors.New("'when' is not boolean")).Msg("")
 			// we consider it false
-			return true
+			return true, false, nil
 		}
 		if !when {
 			// if when is false, we continue to next predicate
-			return true
+			return true, false, nil
 		}
 	}
 
 	if len(o.variable) > 0 {
-		return processVariable(log, o, c)
+		return processVariable(log, o, c), true, nil
 	}
 	if len(o.def) > 0 {
-		return processDefault(log, o, c)
+		return processDefault(log, o, c), true, nil
 	}
 	if o.pipe.Pipe != nil {
-		return pipeHandling(log, c, o)
+		return pipeHandling(log, c, o), true, nil
+	}
+	if o.parallel != nil {
+		return processParallel(log, o, c), true, nil
+	}
+	if o.call != nil {
+		result, err = processCall(log, o, c)
+		return result, true, err
 	}
 	if o.p == nil {
-		log.Error().Err(errors.New("No predicate found")).Msg("")
-		return false
-	}
-	log = log.With().Str("predicate", o.p.Name()).Str("name", o.name).Logger()
-	result := processPredicate(log, o, cfg, c)
-
-	if o.register != "" { // Save predicate results
-		log := log.With().Str("register", o.register).Logger()
-		log.Debug().Msgf("Register result to %v", o.register)
-		if r := o.p.Result(); r != nil {
-			if val, ok := r["result"]; ok {
-				// Predicate is no supposed to use 'result' field
-				log.Warn().Msgf("Value is lost 'result':%v", val)
-			}
-			r["result"] = result // real predicate result, not 'result:' option
-			c.R[o.register] = r
+		err := errors.New("No predicate found")
+		log.Error().Err(err).Msg("")
+		return false, true, err
+	}
+	result, err = processPredicate(log, o, cfg, c)
+	return result, true, err
+}
 
-		} else {
-			// Predicate doesn't any result data, we
-			// just save its boolean evaluation
-			c.R[o.register] = ctx.Result{"result": result}
+// Returns the results of the predicate or 'call' set in o
+func (o *pOptions) results(log zerolog.Logger, result bool, err error) ctx.Result {
+	if o.call != nil {
+		return ctx.Result{"result": result, "error": errorMessage(err),
+			"value": o.returned}
+	}
+	return resultOf(log, o.p, result, err)
+}
+
+// Returns the results of predicate p, including its evaluation and its
+// error message, empty if there was no error
+func resultOf(log zerolog.Logger, p genapid.Predicate, result bool, err error) ctx.Result {
+	// copy, as it may be called several times with 'retry'
+	r := ctx.Result{}
+	for k, v := range p.Result() {
+		if k == "result" || k == "error" {
+			// Predicate is no supposed to use these fields
+			log.Warn().Msgf("Value is lost '%v':%v", k, v)
+			continue
 		}
+		r[k] = v
 	}
+	r["result"] = result // real predicate result, not 'result:' option
+	r["error"] = errorMessage(err)
+	return r
+}
+
+// Returns the message of err, or an empty string if err is nil
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Save predicate results set by 'register' option
+func register(log zerolog.Logger, o *pOptions, c *ctx.Ctx, r ctx.Result) {
+	log = log.With().Str("register", o.register).Logger()
+	log.Debug().Msgf("Register result to %v", o.register)
+	c.R[o.register] = r
+}
+
+// Returns the value of the 'result' option if set, or result
+func resultOption(log zerolog.Logger, o *pOptions, c *ctx.Ctx, result bool) bool {
 	if o.result != "" {
 		if !conf.GetParams(c, o.result, &result) {
 			log.Error().Err(errors.New("'result' is not boolean")).Msg("")
 			return false
 		}
 	}
-	log.Debug().Bool("value", result).Msg("End predicate")
+	if o.pipe.Pipe == nil {
+		log.Debug().Bool("value", result).Msg("End predicate")
+	}
 	return result
 }
 
 func processPredicate(log zerolog.Logger,
-	o *pOptions, cfg *conf.Predicate, c *ctx.Ctx) bool {
+	o *pOptions, cfg *conf.Predicate, c *ctx.Ctx) (bool, error) {
 	name := o.p.Name()
 	log.Debug().Msgf("Found predicate '%v'", name)
 
-	argsNode := (*cfg)[name]
-	args := conf.Params{Name: name}
-	if err := argsNode.Decode(&(args.Conf)); err != nil {
-		log.Error().Err(err).Msgf("Parameters for %v must be a dict", name)
-		return false
+	var result bool
+	var err error
+	if o.retry == nil {
+		result, err = callPredicate(log, o, (*cfg)[name], c)
+	} else {
+		result, err = retryPredicate(log, o, (*cfg)[name], c)
 	}
-	if !genapid.InitPredicate(log, c, o.p, &args) {
-		return false
+	if err != nil {
+		log.Error().Err(err).Msg("")
 	}
+	return result, err
+}
 
-	// Evaluate predicate
-	return o.p.Call(log, c)
+// Set the parameters of the predicate set in o from args, and
+// evaluate it
+func callPredicate(log zerolog.Logger, o *pOptions, argsNode yaml.Node,
+	c *ctx.Ctx) (bool, error) {
+	name := o.p.Name()
+	args := conf.Params{Name: name}
+	result := false
+	var err error
+	if err = c.Context().Err(); err != nil {
+		// incoming request is cancelled or timed out
+		err = fmt.Errorf("Request is done: %w", err)
+	} else if err = argsNode.Decode(&(args.Conf)); err != nil {
+		err = fmt.Errorf("Parameters for %v must be a dict: %w", name, err)
+	} else if err = genapid.Init(c, o.p, &args); err == nil {
+		// Evaluate predicate
+		result, err = evalPredicate(log, o, c)
+	}
+	count(name, result, err)
+	return result, err
 }
 
 // Decode & store an option
-func assignOption(log zerolog.Logger, name string, option *string, n yaml.Node) bool {
+func assignOption(name string, option *string, n yaml.Node) error {
 	if *option != "" {
-		log.Error().Msgf("Several '%v' declared", name)
-		return false
+		return fmt.Errorf("Several '%v' declared", name)
 	}
 	if err := n.Decode(option); err != nil {
-		log.Error().Err(err).Msgf("invalid '%v'", name)
-		return false
+		return fmt.Errorf("invalid '%v': %w", name, err)
 	}
-	return true
+	return nil
 }
 
-func assignVariable(log zerolog.Logger, o *pOptions, n yaml.Node) bool {
-	log = log.With().Str("predicate", "variable").Logger()
+func assignVariable(o *pOptions, n yaml.Node) error {
 	if o.variable != nil {
-		log.Error().Err(errors.New("Several 'variable' declared")).Msg("")
-		return false
+		return errors.New("Several 'variable' declared")
 	}
 	if o.hasPredicate() {
-		log.Error().Err(errors.New("'variable' declared with another predicate")).Msg("")
-		return false
+		return errors.New("'variable' declared with another predicate")
 	}
 	var args []map[string]interface{}
 	if err := n.Decode(&(args)); err != nil {
-		log.Error().Err(err).Msg("'variable' parameters must be a dict")
-		return false
+		return fmt.Errorf("'variable' parameters must be a dict: %w", err)
 	}
 	o.variable = args
-	return true
+	return nil
 }
 
 // Store variable values set by 'variable' option
@@ -210,19 +404,16 @@ func processVariable(log zerolog.Logger, o *pOptions, c *ctx.Ctx) bool {
 }
 
 // Store variable values set by 'default' option
-func assignDefault(log zerolog.Logger, o *pOptions, n yaml.Node) bool {
-	log = log.With().Str("predicate", "default").Logger()
+func assignDefault(o *pOptions, n yaml.Node) error {
 	if o.hasPredicate() {
-		log.Error().Err(errors.New("'default' declared with another predicate")).Msg("")
-		return false
+		return errors.New("'default' declared with another predicate")
 	}
 	d := ctx.DefaultParams{}
 	if err := n.Decode(&d); err != nil {
-		log.Error().Err(err).Msg("'default' parameters must be a dict")
-		return false
+		return fmt.Errorf("'default' parameters must be a dict: %w", err)
 	}
 	o.def = d
-	return true
+	return nil
 }
 
 func processDefault(log zerolog.Logger, o *pOptions, c *ctx.Ctx) bool {
@@ -231,64 +422,77 @@ func processDefault(log zerolog.Logger, o *pOptions, c *ctx.Ctx) bool {
 }
 
 // Find a plugin corresponding to the predicate set in the conf file
-func assignPlugin(log zerolog.Logger, o *pOptions, name string) bool {
+func assignPlugin(o *pOptions, name string) error {
 	if res := plugins.Get(name); res != nil {
 		if o.p != nil {
-			err := fmt.Errorf("Both '%v' & '%v' declared",
+			return fmt.Errorf("Both '%v' & '%v' declared",
 				(o.p).Name(), name)
-			log.Error().Err(err).Msg("")
-			return false
 		}
 		if o.hasPredicate() {
-			err := fmt.Errorf("'%v' declared with another predicate",
+			return fmt.Errorf("'%v' declared with another predicate",
 				name)
-			log.Error().Err(err).Msg("")
-			return false
 		}
 		o.p = res
-		return true
+		return nil
 	}
-	log.Error().
-		Err(fmt.Errorf("Unknown predicate '%v'", name)).Msg("")
-	return false
+	return fmt.Errorf("Unknown predicate '%v'", name)
 }
 
-func assignPipe(log zerolog.Logger, o *pOptions, n yaml.Node) bool {
+func assignPipe(o *pOptions, n yaml.Node) error {
 	if o.pipe.Pipe != nil {
-		log.Error().Msg("Several 'pipe' declared")
-		return false
+		return errors.New("Several 'pipe' declared")
 	}
 	if o.hasPredicate() {
-		log.Error().Msg("'pipe' declared with another predicate")
-		return false
+		return errors.New("'pipe' declared with another predicate")
 	}
 	p := []conf.Predicate{}
 	if err := n.Decode(&p); err != nil {
-		log.Error().Err(err).Msg("invalid 'pipe'")
-		return false
+		return fmt.Errorf("invalid 'pipe': %w", err)
 	}
 	o.pipe.Pipe = p
-	return true
+	return nil
 }
 
-func pipeHandling(log zerolog.Logger, c *ctx.Ctx, o *pOptions) bool {
-	log = log.With().Str("pipe", o.name).Logger()
-	if o.register != "" {
-		log.Error().Err(
-			errors.New("Cannot set 'register' option on a " +
-				" pipe")).Msg("")
-		return false
+// Decode & store the 'rescue' or 'always' section of a pipe
+func assignSection(name string, section *conf.Pipe, n yaml.Node) error {
+	if err := n.Decode(&section.Pipe); err != nil {
+		return fmt.Errorf("invalid '%v': %w", name, err)
 	}
+	if section.Pipe == nil {
+		section.Pipe = []conf.Predicate{}
+	}
+	return nil
+}
+
+// Evaluate the pipe set in o. If a predicate of the pipe is false, the
+// 'rescue' section is evaluated, then the 'always' section is
+// evaluated in all cases. Returns true if all the predicates of the
+// pipe were true.
+func pipeHandling(log zerolog.Logger, c *ctx.Ctx, o *pOptions) bool {
 	o.pipe.Name = o.name
-	ProcessPipe(log, &o.pipe, c)
-	// Always continue after a pipe, unless 'result' option is set
-	// and evaluate to false
-	result := true
-	if o.result != "" {
-		if !conf.GetParams(c, o.result, &result) {
-			log.Error().Err(errors.New("'result' is not boolean")).Msg("")
-			return false
-		}
+	if o.rescue.Pipe == nil && o.always.Pipe == nil {
+		return ProcessPipe(log, &o.pipe, c)
+	}
+	c.Failed = nil
+	result := ProcessPipe(log, &o.pipe, c)
+	if !result && o.rescue.Pipe != nil {
+		log.Debug().Interface("failed", c.Failed).Msg("Processing 'rescue'")
+		o.rescue.Name = o.name + " rescue"
+		processSection(log, &o.rescue, c)
+	}
+	if o.always.Pipe != nil {
+		log.Debug().Msg("Processing 'always'")
+		o.always.Name = o.name + " always"
+		processSection(log, &o.always, c)
 	}
 	return result
 }
+
+// Evaluate the 'rescue' or 'always' section of a pipe, even if the
+// pipe was ended by 'stop'
+func processSection(log zerolog.Logger, section *conf.Pipe, c *ctx.Ctx) {
+	stopped := c.Stopped
+	c.Stopped = false
+	ProcessPipe(log, section, c)
+	c.Stopped = c.Stopped || stopped
+}
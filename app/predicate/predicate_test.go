@@ -5,8 +5,14 @@
 package predicate
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jsautret/genapid/app/conf"
 	"github.com/jsautret/genapid/app/plugins"
@@ -335,10 +341,12 @@ pipe:
 						if exp != nil {
 							// We add boolean result
 							exp["result"] = res
+							exp["error"] = ""
 						} else {
 							// No data is expected, we
 							// just expect boolean result
-							exp = ctx.Result{"result": res}
+							exp = ctx.Result{"result": res,
+								"error": ""}
 						}
 						assert.Equal(t,
 							ctx.Registered{tc.expRegister: exp}, c.R)
@@ -351,6 +359,711 @@ pipe:
 	}
 }
 
+func TestErrorPredicate(t *testing.T) {
+	tt := []struct {
+		name       string
+		conf       string
+		err        error
+		evalResult bool
+		expResult  bool
+		expError   string
+		expFailed  string
+	}{
+		{
+			name:       "True",
+			evalResult: true,
+			expResult:  true,
+			conf: `
+test_error: {}
+register: r
+`,
+		},
+		{
+			name:      "False",
+			expResult: false,
+			expFailed: "'test_error' is false",
+			conf: `
+test_error: {}
+register: r
+`,
+		},
+		{
+			name:       "Error",
+			err:        errors.New("timeout"),
+			evalResult: true, // ignored because of the error
+			expResult:  false,
+			expError:   "timeout",
+			expFailed:  "timeout",
+			conf: `
+test_error: {}
+register: r
+`,
+		},
+		{
+			name:      "ResultOnError",
+			err:       errors.New("timeout"),
+			expResult: true,
+			expError:  "timeout",
+			conf: `
+test_error: {}
+register: r
+result: =R.r.error == "timeout"
+`,
+		},
+	}
+
+	zerolog.SetGlobalLevel(logLevel)
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mocks.ErrorPredicate{}
+			p.On("Name").Return("test_error")
+			plugins.Add(p.Name(), func() genapid.Predicate { return &p })
+			p.On("Eval", mock.Anything, mock.Anything).
+				Return(tc.evalResult, tc.err)
+			p.On("Params").Return(&map[string]interface{}{})
+			p.On("Result").Return(nil)
+			calls := int64(0)
+			if v, ok := predicateMetrics("test_error").Get("calls").(*expvar.Int); ok {
+				calls = v.Value()
+			}
+
+			c := ctx.New()
+			res := Process(log.Logger, getConf(t, tc.conf), c)
+
+			assert.Equal(t, tc.expResult, res)
+			assert.Equal(t, tc.expError, c.R["r"]["error"])
+			assert.Equal(t, tc.evalResult && tc.err == nil,
+				c.R["r"]["result"])
+			if tc.expFailed != "" {
+				require.NotNil(t, c.Failed)
+				assert.Equal(t, tc.expFailed, c.Failed.Error)
+			} else {
+				assert.Nil(t, c.Failed)
+			}
+			p.AssertNotCalled(t, "Call", mock.Anything, mock.Anything)
+			assert.Equal(t, calls+1, predicateMetrics("test_error").
+				Get("calls").(*expvar.Int).Value())
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tt := []struct {
+		name      string
+		conf      string
+		cancelled bool
+		expResult bool
+		expError  string
+	}{
+		{
+			name:      "NoTimeout",
+			expResult: true,
+			conf: `
+test_timeout: {}
+register: r
+`,
+		},
+		{
+			name:     "Timeout",
+			expError: "timeout after 10ms: context deadline exceeded",
+			conf: `
+test_timeout:
+  wait: true
+timeout: 10ms
+register: r
+`,
+		},
+		{
+			name:     "TimeoutExpression",
+			expError: "timeout after 20ms: context deadline exceeded",
+			conf: `
+test_timeout:
+  wait: true
+timeout: =format("%vms", 20)
+register: r
+`,
+		},
+		{
+			name:      "Cancelled",
+			cancelled: true,
+			expError:  "Request is done: context canceled",
+			conf: `
+test_timeout: {}
+timeout: 10ms
+register: r
+`,
+		},
+	}
+
+	zerolog.SetGlobalLevel(logLevel)
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mocks.ErrorPredicate{}
+			p.On("Name").Return("test_timeout")
+			plugins.Add(p.Name(), func() genapid.Predicate { return &p })
+			params := map[string]interface{}{}
+			p.On("Params").Return(&params)
+			p.On("Result").Return(nil)
+			// wait for the context if 'wait' param is set
+			p.On("Eval", mock.Anything, mock.Anything).Return(
+				func(_ zerolog.Logger, c *ctx.Ctx) bool {
+					if params["wait"] == true {
+						<-c.Context().Done()
+						return false
+					}
+					return true
+				},
+				func(_ zerolog.Logger, c *ctx.Ctx) error {
+					return c.Context().Err()
+				})
+
+			c := ctx.New()
+			if tc.cancelled {
+				gc, cancel := context.WithCancel(context.Background())
+				cancel()
+				c.SetContext(gc)
+			}
+			res := Process(log.Logger, getConf(t, tc.conf), c)
+
+			assert.Equal(t, tc.expResult, res)
+			assert.Equal(t, tc.expError, c.R["r"]["error"])
+			if !tc.cancelled {
+				// context of the predicate must not be kept
+				assert.Nil(t, c.Context().Err())
+			}
+		})
+	}
+}
+
+func TestTimeoutOption(t *testing.T) {
+	tt := []struct {
+		name   string
+		conf   string
+		expErr string
+	}{
+		{
+			name:   "Invalid",
+			expErr: "invalid 'timeout': time: invalid duration \"ten\"",
+			conf: `
+match: {}
+timeout: ten
+`,
+		},
+		{
+			name:   "Negative",
+			expErr: "'timeout' must be positive",
+			conf: `
+match: {}
+timeout: -1s
+`,
+		},
+		{
+			name:   "Pipe",
+			expErr: "'timeout' can only be set on a predicate",
+			conf: `
+pipe: []
+timeout: 1s
+`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getOptions(log.Logger, getConf(t, tc.conf))
+			require.NotNil(t, err)
+			assert.Equal(t, tc.expErr, err.Error())
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tt := []struct {
+		name        string
+		conf        string
+		failures    int // number of attempts that fail
+		expResult   bool
+		expError    string
+		expAttempts int
+		minDuration time.Duration
+	}{
+		{
+			name:        "NoRetry",
+			failures:    1,
+			expResult:   false,
+			expError:    "failure 1",
+			expAttempts: 1,
+			conf: `
+test_retry: {}
+register: r
+`,
+		},
+		{
+			name:        "Success",
+			failures:    2,
+			expResult:   true,
+			expAttempts: 3,
+			minDuration: 3 * time.Millisecond,
+			conf: `
+test_retry: {}
+register: r
+retry:
+  attempts: 3
+  delay: 1ms
+  backoff: 2
+  jitter: 1ms
+`,
+		},
+		{
+			name:        "Exhausted",
+			failures:    5,
+			expResult:   false,
+			expError:    "failure 2",
+			expAttempts: 2,
+			conf: `
+test_retry: {}
+register: r
+retry:
+  attempts: 2
+  delay: 1ms
+`,
+		},
+		{
+			name:        "Until",
+			failures:    0,
+			expResult:   true,
+			expAttempts: 3,
+			conf: `
+test_retry: {}
+register: r
+retry:
+  attempts: 5
+  delay: 1ms
+  until: =R.r.code < 500
+`,
+		},
+	}
+
+	zerolog.SetGlobalLevel(logLevel)
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			p := mocks.ErrorPredicate{}
+			p.On("Name").Return("test_retry")
+			plugins.Add(p.Name(), func() genapid.Predicate { return &p })
+			p.On("Params").Return(&map[string]interface{}{})
+			p.On("Eval", mock.Anything, mock.Anything).Return(
+				func(zerolog.Logger, *ctx.Ctx) bool {
+					attempts++
+					return attempts > tc.failures
+				},
+				func(zerolog.Logger, *ctx.Ctx) error {
+					if attempts > tc.failures {
+						return nil
+					}
+					return fmt.Errorf("failure %v", attempts)
+				})
+			// code is 500 for the 2 first attempts
+			p.On("Result").Return(func() ctx.Result {
+				if attempts < 3 {
+					return ctx.Result{"code": 500}
+				}
+				return ctx.Result{"code": 200}
+			})
+
+			c := ctx.New()
+			start := time.Now()
+			res := Process(log.Logger, getConf(t, tc.conf), c)
+
+			assert.Equal(t, tc.expResult, res)
+			assert.Equal(t, tc.expError, c.R["r"]["error"])
+			assert.Equal(t, tc.expAttempts, attempts)
+			assert.GreaterOrEqual(t, int64(time.Since(start)),
+				int64(tc.minDuration))
+		})
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	zerolog.SetGlobalLevel(logLevel)
+	p := mocks.ErrorPredicate{}
+	p.On("Name").Return("test_retry_cancelled")
+	plugins.Add(p.Name(), func() genapid.Predicate { return &p })
+	p.On("Params").Return(&map[string]interface{}{})
+	p.On("Eval", mock.Anything, mock.Anything).Return(false,
+		errors.New("connection refused"))
+
+	c := ctx.New()
+	gc, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	c.SetContext(gc)
+	start := time.Now()
+	res := Process(log.Logger, getConf(t, `
+test_retry_cancelled: {}
+retry:
+  attempts: 3
+  delay: 10s
+`), c)
+	assert.False(t, res)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, "Request is done: context deadline exceeded",
+		c.Failed.Error)
+	p.AssertNumberOfCalls(t, "Eval", 1)
+}
+
+func TestRetryFalse(t *testing.T) {
+	zerolog.SetGlobalLevel(logLevel)
+	p := mocks.ErrorPredicate{}
+	p.On("Name").Return("test_retry_false")
+	plugins.Add(p.Name(), func() genapid.Predicate { return &p })
+	p.On("Params").Return(&map[string]interface{}{})
+	p.On("Eval", mock.Anything, mock.Anything).Return(false, nil)
+
+	res := Process(log.Logger, getConf(t, `
+test_retry_false: {}
+retry:
+  attempts: 3
+  delay: 10s
+`), ctx.New())
+	assert.False(t, res)
+	p.AssertNumberOfCalls(t, "Eval", 1)
+}
+
+// The delay between attempts grows up to max_delay, without
+// overflowing
+func TestRetryDelay(t *testing.T) {
+	o, err := getOptions(log.Logger, getConf(t, `
+match: {}
+retry: {attempts: 1000, delay: 1ms, backoff: 10, max_delay: 1s}
+`))
+	require.Nil(t, err)
+	delays := []time.Duration{}
+	delay := time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		delay = o.retry.nextDelay(delay)
+		if i < 5 {
+			delays = append(delays, delay)
+		}
+		require.Equal(t, true, delay > 0 && delay <= time.Second,
+			"attempt %v: %v", i, delay)
+	}
+	assert.Equal(t, []time.Duration{time.Millisecond,
+		10 * time.Millisecond, 100 * time.Millisecond, time.Second,
+		time.Second}, delays)
+}
+
+func TestRetryOption(t *testing.T) {
+	tt := []struct {
+		name   string
+		conf   string
+		expErr string
+	}{
+		{
+			name:   "Attempts",
+			expErr: "'retry' attempts must be at least 1",
+			conf:   "retry: 0",
+		},
+		{
+			name:   "Delay",
+			expErr: "invalid 'retry' delay: time: invalid duration \"x\"",
+			conf:   "retry: {delay: x}",
+		},
+		{
+			name:   "Backoff",
+			expErr: "'retry' backoff must be at least 1",
+			conf:   "retry: {backoff: 0.5}",
+		},
+		{
+			name:   "Until",
+			expErr: "'retry' until must be an expression",
+			conf:   "retry: {until: true}",
+		},
+		{
+			name:   "MaxDelay",
+			expErr: "'retry' max_delay must be strictly positive",
+			conf:   "retry: {max_delay: 0s}",
+		},
+		{
+			name:   "UntilRegister",
+			expErr: "'retry' until requires 'register'",
+			conf:   "retry: {until: =true}",
+		},
+		{
+			name:   "Unknown",
+			expErr: "invalid 'retry'",
+			conf:   "retry: {tries: 2}",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getOptions(log.Logger, getConf(t,
+				"match: {}\n"+tc.conf))
+			require.NotNil(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), tc.expErr),
+				"got %v", err)
+		})
+	}
+	o, err := getOptions(log.Logger, getConf(t, "match: {}\nretry: 4"))
+	require.Nil(t, err)
+	assert.Equal(t, &retryOptions{attempts: 4, delay: time.Second,
+		backoff: 1, maxDelay: time.Minute}, o.retry)
+
+	_, err = getOptions(log.Logger, getConf(t, "pipe: []\nretry: 2"))
+	require.NotNil(t, err)
+	assert.Equal(t, "'retry' can only be set on a predicate", err.Error())
+}
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool(1, 1)
+	release := make(chan bool)
+	done := make(chan int, 3)
+	job := func(i int) func() {
+		return func() {
+			<-release
+			done <- i
+		}
+	}
+	require.Nil(t, p.submit(job(1)))
+	// wait for the worker to take the first job
+	for len(p.jobs) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	require.Nil(t, p.submit(job(2)), "must be queued")
+	assert.NotNil(t, p.submit(job(3)), "queue must be full")
+	close(release)
+	p.wait()
+	assert.Equal(t, 2, len(done))
+	assert.NotNil(t, p.submit(job(4)), "pool must be closed")
+
+	// a panic must not stop the worker
+	p = newWorkerPool(1, 2)
+	require.Nil(t, p.submit(func() { panic("test") }))
+	require.Nil(t, p.submit(func() { done <- 5 }))
+	p.wait()
+	assert.Equal(t, 3, len(done))
+}
+
+func TestAsyncOption(t *testing.T) {
+	_, err := getOptions(log.Logger, getConf(t, `
+match: {}
+async: true
+register: r
+`))
+	require.NotNil(t, err)
+	assert.Equal(t, "'register' cannot be set with 'async'", err.Error())
+}
+
+func TestParallelOption(t *testing.T) {
+	tt := []struct {
+		name   string
+		conf   string
+		expErr string
+	}{
+		{
+			name:   "Require",
+			expErr: "'require' must be 'all' or 'any'",
+			conf:   "parallel: []\nrequire: one",
+		},
+		{
+			name:   "Limit",
+			expErr: "'limit' must be positive",
+			conf:   "parallel: []\nlimit: -1",
+		},
+		{
+			name:   "NoParallel",
+			expErr: "'limit' & 'require' can only be set on 'parallel'",
+			conf:   "pipe: []\nlimit: 1",
+		},
+		{
+			name:   "Register",
+			expErr: "Cannot set 'register' option on 'parallel'",
+			conf:   "parallel: []\nregister: r",
+		},
+		{
+			name:   "WithPipe",
+			expErr: "declared with another predicate",
+			conf:   "parallel: []\npipe: []",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getOptions(log.Logger, getConf(t, tc.conf))
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), tc.expErr)
+		})
+	}
+}
+
+// A panic in a branch must not kill the daemon
+func TestParallelPanic(t *testing.T) {
+	zerolog.SetGlobalLevel(logLevel)
+	p := mocks.ErrorPredicate{}
+	p.On("Name").Return("test_panic")
+	plugins.Add(p.Name(), func() genapid.Predicate { return &p })
+	p.On("Params").Return(&map[string]interface{}{})
+	p.On("Eval", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		panic("boom")
+	})
+
+	for _, require := range []string{"all", "any"} {
+		c := ctx.New()
+		res := Process(log.Logger, getConf(t, `
+parallel:
+  - test_panic: {}
+  - variable:
+      - x: done
+require: `+require), c)
+		assert.Equal(t, require == "any", res, require)
+		assert.Equal(t, "done", c.V["x"])
+	}
+}
+
+func TestCallOption(t *testing.T) {
+	tt := []struct {
+		name   string
+		conf   string
+		expErr string
+	}{
+		{
+			name:   "NoName",
+			expErr: "'call' must have a name",
+			conf:   "call: {args: {a: 1}}",
+		},
+		{
+			name:   "WithPipe",
+			expErr: "declared with another predicate",
+			conf:   "call: {name: f}\npipe: []",
+		},
+		{
+			name:   "Args",
+			expErr: "invalid 'call'",
+			conf:   "call: {name: f, args: [a]}",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getOptions(log.Logger, getConf(t, tc.conf))
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), tc.expErr)
+		})
+	}
+}
+
+func TestRouteOption(t *testing.T) {
+	tt := []struct {
+		name   string
+		conf   string
+		expErr string
+	}{
+		{
+			name:   "NoPipe",
+			expErr: "'route' can only be set on a pipe",
+			conf:   "route: /a\nlog: {msg: a}",
+		},
+		{
+			name:   "Invalid",
+			expErr: "invalid 'route': path 'a' must start with '/'",
+			conf:   "route: GET a\npipe: []",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getOptions(log.Logger, getConf(t, tc.conf))
+			require.NotNil(t, err)
+			assert.Equal(t, tc.expErr, err.Error())
+		})
+	}
+
+	cfg := conf.Root{}
+	require.Nil(t, yaml.Unmarshal([]byte(`
+- log: {msg: a}
+- route: GET /a/{id}
+  pipe: []
+- route: GET /a/{x}
+  pipe: []
+`), &cfg))
+	r := Routes(log.Logger, cfg)
+	require.NotNil(t, r)
+	m, _ := r.Lookup("GET", "/a/1")
+	require.NotNil(t, m)
+	assert.Equal(t, 1, m.Value, "first route wins")
+	assert.Nil(t, Routes(log.Logger, cfg[:1]))
+}
+
+func TestDefine(t *testing.T) {
+	tt := []struct {
+		name     string
+		conf     string
+		expErr   string
+		params   map[string]interface{}
+		required []string
+	}{
+		{
+			name:     "List",
+			conf:     "{name: f, params: [b, a], pipe: []}",
+			params:   map[string]interface{}{"a": nil, "b": nil},
+			required: []string{"a", "b"},
+		},
+		{
+			name:     "Dict",
+			conf:     "{name: f, params: {a: 1, b: }, pipe: []}",
+			params:   map[string]interface{}{"a": 1, "b": nil},
+			required: []string{"b"},
+		},
+		{
+			name:   "NoParams",
+			conf:   "{name: f, pipe: []}",
+			params: map[string]interface{}{},
+		},
+		{
+			name:   "NoName",
+			conf:   "{pipe: []}",
+			expErr: "'define' must have a name",
+		},
+		{
+			name:   "NoPipe",
+			conf:   "{name: f}",
+			expErr: "'define' f must have a pipe",
+		},
+		{
+			name:   "UnknownField",
+			conf:   "{name: f, pipe: [], args: {}}",
+			expErr: "unknown field 'args' in 'define'",
+		},
+		{
+			name:   "InvalidParams",
+			conf:   "{name: f, pipe: [], params: a}",
+			expErr: "'params' of f must be a list or a dict",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			n := yaml.Node{}
+			require.Nil(t, yaml.Unmarshal([]byte(tc.conf), &n))
+			d, err := parseDefinition(n.Content[0])
+			if tc.expErr != "" {
+				require.NotNil(t, err)
+				assert.Equal(t, tc.expErr, err.Error())
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.params, d.params)
+			assert.Equal(t, tc.required, d.required)
+		})
+	}
+
+	cfg := conf.Root{}
+	require.Nil(t, yaml.Unmarshal([]byte(`
+- define: {name: f, pipe: []}
+- log: {msg: a}
+- define: {name: f, pipe: []}
+- define: {name: g, pipe: []}
+`), &cfg))
+	c := ctx.New()
+	Define(log.Logger, &cfg, c)
+	assert.Len(t, cfg, 1, "'define' must be removed from the conf")
+	assert.Len(t, c.Defined, 2)
+}
+
 /***************************************************************************
   Helpers
   ***************************************************************************/
@@ -0,0 +1,170 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/app/plugins"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// retryOptions are set by the 'retry' option
+type retryOptions struct {
+	attempts int
+	delay    time.Duration
+	backoff  float64
+	maxDelay time.Duration
+	jitter   time.Duration
+	until    string
+}
+
+// Store the 'retry' option, a number of attempts or a dict
+func assignRetry(o *pOptions, n yaml.Node) error {
+	r := retryOptions{attempts: 3, delay: time.Second, backoff: 1,
+		maxDelay: time.Minute}
+	if n.Kind == yaml.ScalarNode {
+		if err := n.Decode(&r.attempts); err != nil {
+			return fmt.Errorf("invalid 'retry': %w", err)
+		}
+	} else {
+		var fields map[string]interface{}
+		if err := n.Decode(&fields); err != nil {
+			return fmt.Errorf("invalid 'retry': %w", err)
+		}
+		for k := range fields {
+			switch k {
+			case "attempts", "delay", "backoff", "max_delay", "jitter", "until":
+			default:
+				return fmt.Errorf("invalid 'retry': unknown parameter '%v'", k)
+			}
+		}
+		var args struct {
+			Attempts *int
+			Delay    string
+			Backoff  *float64
+			MaxDelay string `yaml:"max_delay"`
+			Jitter   string
+			Until    string
+		}
+		if err := n.Decode(&args); err != nil {
+			return fmt.Errorf("invalid 'retry': %w", err)
+		}
+		if args.Attempts != nil {
+			r.attempts = *args.Attempts
+		}
+		if args.Backoff != nil {
+			r.backoff = *args.Backoff
+		}
+		var err error
+		if args.Delay != "" {
+			if r.delay, err = time.ParseDuration(args.Delay); err != nil {
+				return fmt.Errorf("invalid 'retry' delay: %w", err)
+			}
+		}
+		if args.MaxDelay != "" {
+			if r.maxDelay, err = time.ParseDuration(args.MaxDelay); err != nil {
+				return fmt.Errorf("invalid 'retry' max_delay: %w", err)
+			}
+		}
+		if args.Jitter != "" {
+			if r.jitter, err = time.ParseDuration(args.Jitter); err != nil {
+				return fmt.Errorf("invalid 'retry' jitter: %w", err)
+			}
+		}
+		if args.Until != "" && !conf.IsExpression(args.Until) {
+			return errors.New("'retry' until must be an expression")
+		}
+		r.until = args.Until
+	}
+	switch {
+	case r.attempts < 1:
+		return errors.New("'retry' attempts must be at least 1")
+	case r.delay < 0 || r.jitter < 0:
+		return errors.New("'retry' delay & jitter must be positive")
+	case r.maxDelay <= 0:
+		return errors.New("'retry' max_delay must be strictly positive")
+	case r.backoff < 1:
+		return errors.New("'retry' backoff must be at least 1")
+	}
+	o.retry = &r
+	return nil
+}
+
+// Evaluate the predicate set in o until it returns no error, or until
+// the 'until' expression is true if it is set, waiting between attempts.
+// Each attempt uses a new instance of the predicate.
+func retryPredicate(log zerolog.Logger, o *pOptions, args yaml.Node,
+	c *ctx.Ctx) (result bool, err error) {
+	r := o.retry
+	delay := r.nextDelay(0)
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			o.p = plugins.Get(o.p.Name())
+		}
+		log := log.With().Int("attempt", attempt).Logger()
+		result, err = callPredicate(log, o, args, c)
+		done, uerr := retryDone(log, o, c, result, err)
+		if uerr != nil {
+			return false, uerr
+		}
+		if done || attempt >= r.attempts || c.Context().Err() != nil {
+			return result, err
+		}
+		wait := delay
+		if r.jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(r.jitter)))
+		}
+		log.Warn().Err(err).Bool("value", result).
+			Msgf("Attempt failed, retrying in %v", wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-c.Context().Done():
+			t.Stop()
+			return false, fmt.Errorf("Request is done: %w",
+				c.Context().Err())
+		}
+		delay = r.nextDelay(delay)
+	}
+}
+
+// Returns the delay before the attempt following the one that waited
+// delay, 0 for the first one, at most maxDelay
+func (r *retryOptions) nextDelay(delay time.Duration) time.Duration {
+	next := float64(r.delay)
+	if delay > 0 {
+		next = float64(delay) * r.backoff
+	}
+	// compared as float, the conversion may overflow
+	if next > float64(r.maxDelay) {
+		return r.maxDelay
+	}
+	return time.Duration(next)
+}
+
+// Returns true if the last attempt succeeded: the 'until' expression
+// is true if it is set, or the predicate returned no error. A false
+// predicate is not retried by default, as it's usually a normal result,
+// like a 'match' that does not match. The results of the attempt are
+// registered before 'until' is evaluated, so it can use them.
+func retryDone(log zerolog.Logger, o *pOptions, c *ctx.Ctx,
+	result bool, err error) (bool, error) {
+	if o.retry.until == "" {
+		return err == nil, nil
+	}
+	register(log, o, c, o.results(log, result, err))
+	var until bool
+	if !conf.GetParams(c, o.retry.until, &until) {
+		return false, errors.New("'retry' until is not boolean")
+	}
+	return until, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/app/router"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+var errNestedRoute = errors.New("'route' can only be set on a top-level pipe")
+
+func assignRoute(o *pOptions, n yaml.Node) error {
+	if err := assignOption("route", &o.route, n); err != nil {
+		return err
+	}
+	if _, _, err := router.Parse(o.route); err != nil {
+		return fmt.Errorf("invalid 'route': %w", err)
+	}
+	return nil
+}
+
+// Routes returns a router.Router with the 'route' options of the
+// top-level pipes of cfg. The value of each route is the index of its
+// pipe in cfg. Returns nil if there is no 'route'.
+func Routes(log zerolog.Logger, cfg conf.Root) *router.Router {
+	var r *router.Router
+	for i, p := range cfg {
+		if _, ok := p["route"]; !ok {
+			continue
+		}
+		o, err := getOptions(log, &p)
+		if err != nil {
+			// reported when the pipe is evaluated
+			continue
+		}
+		if r == nil {
+			r = router.New()
+		}
+		if err := r.Add(o.route, i); err != nil {
+			log.Error().Err(err).Str("pipe", o.name).Msg("Invalid 'route'")
+			continue
+		}
+		log.Debug().Str("route", o.route).Str("pipe", o.name).Msg("Route added")
+	}
+	return r
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package predicate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// Store the duration set by 'timeout' option, a duration like "5s" or
+// an expression
+func assignTimeout(o *pOptions, n yaml.Node) error {
+	if err := assignOption("timeout", &o.timeout, n); err != nil {
+		return err
+	}
+	if conf.IsExpression(o.timeout) {
+		return nil
+	}
+	if _, err := parseTimeout(o.timeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns the duration of a 'timeout' option
+func parseTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid 'timeout': %w", err)
+	}
+	if d <= 0 {
+		return 0, errors.New("'timeout' must be positive")
+	}
+	return d, nil
+}
+
+// Evaluate the predicate set in o. If the 'timeout' option is set,
+// the context.Context of c is cancelled when it expires.
+func evalPredicate(log zerolog.Logger, o *pOptions, c *ctx.Ctx) (bool, error) {
+	if o.timeout == "" {
+		return genapid.Eval(log, c, o.p)
+	}
+	var s string
+	if !conf.GetParams(c, o.timeout, &s) {
+		return false, errors.New("'timeout' is not a string")
+	}
+	d, err := parseTimeout(s)
+	if err != nil {
+		return false, err
+	}
+	parent := c.Context()
+	tc, cancel := context.WithTimeout(parent, d)
+	defer cancel()
+	c.SetContext(tc)
+	defer c.SetContext(parent)
+
+	result, err := genapid.Eval(log, c, o.p)
+	if err != nil && tc.Err() == context.DeadlineExceeded &&
+		parent.Err() == nil {
+		err = fmt.Errorf("timeout after %v: %w", d, err)
+	}
+	return result, err
+}
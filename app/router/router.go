@@ -0,0 +1,197 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+// Package router finds the route matching the method & path of a
+// request. Routes look like "POST /kodi/{action}/{id}": the method is
+// optional, a segment of the path can be a parameter in braces, and
+// the last one can be "{name...}" to match the rest of the path.
+package router
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Router stores routes as a tree of path segments
+type Router struct {
+	root node
+}
+
+// Match is the route found for a request
+type Match struct {
+	// Value set with the route
+	Value interface{}
+	// Values of the parameters of the route, by name
+	Params map[string]string
+}
+
+type node struct {
+	static map[string]*node
+	// child for a parameter, whatever its name
+	param *node
+	// routes ending with a "{name...}" parameter
+	rest map[string]*route
+	// routes ending on this node, by method ("" for all)
+	routes map[string]*route
+}
+
+type route struct {
+	value interface{}
+	// names of the parameters, in the order of the path
+	params []string
+}
+
+var (
+	methodRe = regexp.MustCompile(`^[A-Z]+$`)
+	paramRe  = regexp.MustCompile(`^\{([A-Za-z_][A-Za-z0-9_]*)(\.\.\.)?\}$`)
+)
+
+// New returns an empty Router
+func New() *Router {
+	return &Router{}
+}
+
+// Parse splits route into its method, empty if not set, and its path
+func Parse(route string) (method, path string, err error) {
+	f := strings.Fields(route)
+	switch len(f) {
+	case 1:
+		path = f[0]
+	case 2:
+		method, path = f[0], f[1]
+		if !methodRe.MatchString(method) {
+			return "", "", fmt.Errorf("invalid method '%v'", method)
+		}
+	default:
+		return "", "", errors.New("route must be '[METHOD] /path'")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", "", fmt.Errorf("path '%v' must start with '/'", path)
+	}
+	return method, path, nil
+}
+
+// Add adds route, which value is returned by Lookup when it
+// matches. Returns an error if route is invalid or already added.
+func (r *Router) Add(route string, value interface{}) error {
+	method, path, err := Parse(route)
+	if err != nil {
+		return err
+	}
+	n := &r.root
+	var params []string
+	segments := strings.Split(path[1:], "/")
+	for i, s := range segments {
+		if !strings.HasPrefix(s, "{") {
+			if n.static == nil {
+				n.static = map[string]*node{}
+			}
+			if n.static[s] == nil {
+				n.static[s] = &node{}
+			}
+			n = n.static[s]
+			continue
+		}
+		m := paramRe.FindStringSubmatch(s)
+		if m == nil {
+			return fmt.Errorf("invalid parameter '%v'", s)
+		}
+		for _, p := range params {
+			if p == m[1] {
+				return fmt.Errorf("parameter '%v' set several times", p)
+			}
+		}
+		params = append(params, m[1])
+		if m[2] != "" {
+			if i != len(segments)-1 {
+				return fmt.Errorf("'%v' must be at the end of the path", s)
+			}
+			return n.addRoute(&n.rest, method, value, params, route)
+		}
+		if n.param == nil {
+			n.param = &node{}
+		}
+		n = n.param
+	}
+	return n.addRoute(&n.routes, method, value, params, route)
+}
+
+func (n *node) addRoute(routes *map[string]*route, method string,
+	value interface{}, params []string, r string) error {
+	if *routes == nil {
+		*routes = map[string]*route{}
+	}
+	if _, ok := (*routes)[method]; ok {
+		return fmt.Errorf("route '%v' already defined", r)
+	}
+	(*routes)[method] = &route{value: value, params: params}
+	return nil
+}
+
+// Lookup returns the route matching method & path. Static segments
+// are preferred to parameters. If no route matches, it returns nil
+// and the methods of the routes matching path, if any.
+func (r *Router) Lookup(method, path string) (*Match, []string) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	allowed := map[string]bool{}
+	rt, values := r.root.lookup(method, segments, nil, allowed)
+	if rt == nil {
+		var methods []string
+		for m := range allowed {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		return nil, methods
+	}
+	m := &Match{Value: rt.value, Params: map[string]string{}}
+	for i, p := range rt.params {
+		m.Params[p] = values[i]
+	}
+	return m, nil
+}
+
+// Returns the route matching method for segments from node n, and
+// the values of its parameters, appended to values. allowed gets the
+// methods of the routes matching the path.
+func (n *node) lookup(method string, segments, values []string,
+	allowed map[string]bool) (*route, []string) {
+	if len(segments) == 0 {
+		if rt := match(n.routes, method, allowed); rt != nil {
+			return rt, values
+		}
+		return nil, nil
+	}
+	if c := n.static[segments[0]]; c != nil {
+		if rt, v := c.lookup(method, segments[1:], values, allowed); rt != nil {
+			return rt, v
+		}
+	}
+	if n.param != nil && segments[0] != "" {
+		if rt, v := n.param.lookup(method, segments[1:],
+			append(values, segments[0]), allowed); rt != nil {
+			return rt, v
+		}
+	}
+	if rt := match(n.rest, method, allowed); rt != nil {
+		return rt, append(values, strings.Join(segments, "/"))
+	}
+	return nil, nil
+}
+
+// Returns the route of routes for method
+func match(routes map[string]*route, method string, allowed map[string]bool) *route {
+	if rt, ok := routes[method]; ok {
+		return rt
+	}
+	if rt, ok := routes[""]; ok {
+		return rt
+	}
+	for m := range routes {
+		allowed[m] = true
+	}
+	return nil
+}
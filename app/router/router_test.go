@@ -0,0 +1,91 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdd(t *testing.T) {
+	tt := []struct {
+		name   string
+		route  string
+		expErr string
+	}{
+		{name: "NoSlash", route: "GET kodi", expErr: "path 'kodi' must start with '/'"},
+		{name: "Method", route: "get /kodi", expErr: "invalid method 'get'"},
+		{name: "TooMany", route: "GET /kodi x", expErr: "route must be '[METHOD] /path'"},
+		{name: "Param", route: "/kodi/{a-b}", expErr: "invalid parameter '{a-b}'"},
+		{name: "ParamPrefix", route: "/kodi/{a}b", expErr: "invalid parameter '{a}b'"},
+		{name: "SameParam", route: "/{a}/{a}", expErr: "parameter 'a' set several times"},
+		{name: "Rest", route: "/{a...}/b", expErr: "'{a...}' must be at the end of the path"},
+		{name: "Duplicate", route: "GET /a/{x}", expErr: "route 'GET /a/{x}' already defined"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := New()
+			require.Nil(t, r.Add("GET /a/{id}", 0))
+			err := r.Add(tc.route, 1)
+			require.NotNil(t, err)
+			assert.Equal(t, tc.expErr, err.Error())
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r := New()
+	for i, route := range []string{
+		"GET /",
+		"GET /kodi/{action}/{id}",
+		"POST /kodi/{action}/{id}",
+		"GET /kodi/play/{id}",
+		"/any",
+		"PUT /kodi/stop/{id}",
+		"GET /files/{path...}",
+	} {
+		require.Nil(t, r.Add(route, i), route)
+	}
+	tt := []struct {
+		name    string
+		method  string
+		path    string
+		value   interface{}
+		params  map[string]string
+		allowed []string
+	}{
+		{name: "Root", method: "GET", path: "/", value: 0,
+			params: map[string]string{}},
+		{name: "Params", method: "POST", path: "/kodi/pause/12", value: 2,
+			params: map[string]string{"action": "pause", "id": "12"}},
+		{name: "Static", method: "GET", path: "/kodi/play/12", value: 3,
+			params: map[string]string{"id": "12"}},
+		{name: "Backtrack", method: "POST", path: "/kodi/play/12", value: 2,
+			params: map[string]string{"action": "play", "id": "12"}},
+		{name: "AnyMethod", method: "DELETE", path: "/any", value: 4,
+			params: map[string]string{}},
+		{name: "Rest", method: "GET", path: "/files/a/b.txt", value: 6,
+			params: map[string]string{"path": "a/b.txt"}},
+		{name: "NotFound", method: "GET", path: "/kodi/play"},
+		{name: "EmptyParam", method: "GET", path: "/kodi//12"},
+		{name: "NotAllowed", method: "DELETE", path: "/kodi/stop/1",
+			allowed: []string{"GET", "POST", "PUT"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m, allowed := r.Lookup(tc.method, tc.path)
+			assert.Equal(t, tc.allowed, allowed)
+			if tc.value == nil {
+				assert.Nil(t, m)
+				return
+			}
+			require.NotNil(t, m)
+			assert.Equal(t, tc.value, m.Value)
+			assert.Equal(t, tc.params, m.Params)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/app/predicate"
+	"github.com/jsautret/genapid/app/router"
+	"gopkg.in/yaml.v3"
+)
+
+// Statically check the conf, without evaluating it, and returns the
+// problems found
+func check(cfg *conf.Config) conf.Errors {
+	doc := cfg.Node
+	if doc == nil || doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 {
+		return nil
+	}
+	var errs conf.Errors
+	// 'init' must be first, 'define', 'options', 'shutdown' & 'server'
+	// excepted
+	first := true
+	options, shutdowns, servers := 0, 0, 0
+	routes := router.New()
+	for _, n := range doc.Content[0].Content {
+		file := cfg.FileOf(n, cfg.Files[0])
+		if conf.MapValue(n, "define") != nil {
+			errs = append(errs, predicate.CheckDefine(cfg, n, file)...)
+			continue
+		}
+		if opts := conf.MapValue(n, "options"); opts != nil {
+			options++
+			errs = append(errs, checkOptions(n, opts, file, options)...)
+			continue
+		}
+		if server := conf.MapValue(n, "server"); server != nil {
+			servers++
+			errs = append(errs, checkServer(n, server, file, servers)...)
+			continue
+		}
+		if init := conf.MapValue(n, "init"); first && init != nil {
+			first = false
+			errs = append(errs, checkList(cfg, "init", n, init, file)...)
+			continue
+		}
+		if shutdown := conf.MapValue(n, "shutdown"); shutdown != nil {
+			shutdowns++
+			if shutdowns > 1 {
+				errs = append(errs, &conf.Error{File: file,
+					Line: n.Line, Column: n.Column,
+					Err: errors.New("'shutdown' set several times")})
+			}
+			errs = append(errs, checkList(cfg, "shutdown", n, shutdown, file)...)
+			continue
+		}
+		first = false
+		if route := conf.MapValue(n, "route"); route != nil {
+			errs = append(errs, checkRoute(routes, route, file)...)
+		}
+		errs = append(errs, predicate.Check(cfg, n, file)...)
+	}
+	return errs
+}
+
+// Check the 'init' or 'shutdown' statement n, whose predicates are
+// in list
+func checkList(cfg *conf.Config, name string, n, list *yaml.Node, file string) conf.Errors {
+	var errs conf.Errors
+	if len(n.Content) > 2 {
+		errs = append(errs, &conf.Error{File: file,
+			Line: n.Line, Column: n.Column,
+			Err: fmt.Errorf("'%v' must be used alone", name)})
+	}
+	if list.Kind != yaml.SequenceNode {
+		return append(errs, &conf.Error{File: file,
+			Line: list.Line, Column: list.Column,
+			Err: fmt.Errorf("Invalid values for '%v'", name)})
+	}
+	for _, p := range list.Content {
+		errs = append(errs, predicate.CheckNested(cfg, p, cfg.FileOf(p, file))...)
+	}
+	return errs
+}
+
+// Check the 'options' statement n, the count-th one of the conf
+func checkOptions(n, opts *yaml.Node, file string, count int) conf.Errors {
+	var errs conf.Errors
+	add := func(n *yaml.Node, err error) {
+		errs = append(errs, &conf.Error{File: file,
+			Line: n.Line, Column: n.Column, Err: err})
+	}
+	if count > 1 {
+		add(n, errors.New("'options' set several times"))
+	}
+	if len(n.Content) > 2 {
+		add(n, errors.New("'options' must be used alone"))
+	}
+	if _, err := parseOptions(opts); err != nil {
+		add(opts, err)
+	}
+	return errs
+}
+
+// Check the 'server' statement n, the count-th one of the conf
+func checkServer(n, server *yaml.Node, file string, count int) conf.Errors {
+	var errs conf.Errors
+	if count > 1 {
+		errs = append(errs, &conf.Error{File: file,
+			Line: n.Line, Column: n.Column,
+			Err: errors.New("'server' set several times")})
+	}
+	if len(n.Content) > 2 {
+		errs = append(errs, &conf.Error{File: file,
+			Line: n.Line, Column: n.Column,
+			Err: errors.New("'server' must be used alone")})
+	}
+	for _, e := range parseServer(server) {
+		e.File = file
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// Add route to routes, to check it is not set on several pipes
+func checkRoute(routes *router.Router, route *yaml.Node, file string) conf.Errors {
+	if _, _, err := router.Parse(route.Value); err != nil {
+		// already reported by predicate.Check
+		return nil
+	}
+	if err := routes.Add(route.Value, nil); err != nil {
+		return conf.Errors{{File: file, Line: route.Line,
+			Column: route.Column, Err: err}}
+	}
+	return nil
+}
+
+// Run the 'check' command, returns the exit code
+func runCheck() int {
+	cfg, err := conf.ReadConfFile(configFileName)
+	var errs conf.Errors
+	switch {
+	case errors.As(err, &errs):
+	case err != nil:
+		errs = conf.Errors{{File: configFileName, Err: err}}
+	default:
+		errs = check(cfg)
+	}
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+	if len(errs) != 0 {
+		fmt.Printf("%v problem(s) found\n", len(errs))
+		return 1
+	}
+	fmt.Printf("%v: OK\n", configFileName)
+	return 0
+}
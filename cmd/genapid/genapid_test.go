@@ -6,18 +6,38 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/app/predicate"
 	"github.com/jsautret/genapid/ctx"
 	"github.com/jsautret/zltest"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
 	"gopkg.in/yaml.v3"
 )
 
@@ -25,6 +45,27 @@ var logLevel = zerolog.InfoLevel
 
 var checkLog = true
 
+// conf used by the Route* cases of TestFullConf
+const routesConf = `
+- log:
+    msg: =format("Always %v", P.id)
+- route: GET /kodi/{action}/{id}
+  pipe:
+  - response:
+      body:
+        string: =format("%v %v", P.action, P.id)
+- name: NotExecuted
+  route: POST /kodi/{action}/{id}
+  pipe:
+  - log:
+      msg: NotExecuted
+- route: GET /kodi/play/{id}
+  pipe:
+  - response:
+      body:
+        string: =format("play %v", P.id)
+`
+
 func TestFullConf(t *testing.T) {
 	type expLog []map[string]string
 	tt := []struct {
@@ -34,6 +75,7 @@ func TestFullConf(t *testing.T) {
 		mime        string
 		body        string
 		want        string
+		wantHeaders map[string]string
 		statusCode  int
 		conf        string
 		logFound    expLog
@@ -395,6 +437,557 @@ func TestFullConf(t *testing.T) {
 - name: End
   log:
     msg: End
+`,
+		},
+		{
+			name:       "ResponseString",
+			method:     http.MethodGet,
+			path:       "/ResponseString?who=world",
+			statusCode: http.StatusCreated,
+			want:       "Hello world",
+			wantHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+				"X-Test":       "ResponseString",
+			},
+			conf: `
+- name: "ResponseString"
+  pipe:
+    - variable:
+        - who: '=In.URL.Query()|who[0]'
+    - response:
+        code: 201
+        headers:
+          X-Test: ResponseString
+        body:
+          string: '="Hello " + V.who'
+`,
+		},
+		{
+			name:       "ResponseJSON",
+			method:     http.MethodGet,
+			path:       "/ResponseJSON",
+			statusCode: http.StatusOK,
+			want:       `{"matches":["BAAABB","AAAB"],"text":"fulfillment"}`,
+			wantHeaders: map[string]string{
+				"Content-Type": "application/json",
+			},
+			conf: `
+- name: "ResponseJSON"
+  pipe:
+    - match:
+        string: "BBBAAABBB"
+        regexp: "B(A+B)B"
+      register: match
+    - response:
+        body:
+          json:
+            text: fulfillment
+            matches: =R.match.matches
+`,
+		},
+		{
+			name:        "ResponseFirstWins",
+			method:      http.MethodGet,
+			path:        "/ResponseFirstWins",
+			statusCode:  http.StatusForbidden,
+			want:        "first",
+			logFound:    expLog{{"error": "Response already set"}},
+			logNotFound: expLog{{"log": "NotExecuted"}},
+			conf: `
+- name: "ResponseFirstWins"
+  pipe:
+    - response:
+        code: 403
+        body:
+          string: first
+    - response:
+        code: 200
+        body:
+          string: second
+    - log: # will not be evaluated
+        msg: NotExecuted
+`,
+		},
+		{
+			name:       "LoopPredicate",
+			method:     http.MethodGet,
+			path:       "/LoopPredicate",
+			statusCode: http.StatusOK,
+			want:       "false 3 d 0",
+			conf: `
+- match:
+    string: =Item
+    regexp: "^a(.*)$"
+  loop: [abc, b, ad]
+  register: m
+  result: =true
+- response:
+    body:
+      string: '=format("%v %v %v %v", R.m.result, len(R.m.results), R.m.results[2].matches[1], Index)'
+`,
+		},
+		{
+			name:       "LoopBreak",
+			method:     http.MethodGet,
+			path:       "/LoopBreak",
+			statusCode: http.StatusOK,
+			want:       "2",
+			logFound:   expLog{{"log": "AfterLoop"}},
+			conf: `
+- variable:
+  - list: [a, b, a]
+- match:
+    string: a
+    value: =Item
+  loop: =V.list
+  loop_break: true
+  register: m
+  result: =!R.m.result
+- response:
+    body:
+      string: '=format("%v", len(R.m.results))'
+- log:
+    msg: AfterLoop
+`,
+		},
+		{
+			name:       "LoopPipe",
+			method:     http.MethodGet,
+			path:       "/LoopPipe",
+			statusCode: http.StatusOK,
+			want:       "0x1;[a][b]x 1y2;[a][b]y",
+			conf: `
+- variable:
+  - s: ""
+- loop:
+    x: 1
+    y: 2
+    z: 3
+  when: '=Item.key != "z"'
+  pipe:
+  - variable:
+    - s: '=V.s + format("%v%v%v;", Index, Item.key, Item.value)'
+  - variable:
+    - s: '=V.s + format("[%v]", Item)'
+    loop: [a, b]
+  - variable:
+    - s: '=V.s + Item.key + " "'
+- response:
+    body:
+      string: =V.s
+`,
+		},
+		{
+			name:        "Rescue",
+			method:      http.MethodGet,
+			path:        "/Rescue",
+			statusCode:  http.StatusBadGateway,
+			want:        "match 'Call Kodi' failed: 'match' is false",
+			logFound:    expLog{{"log": "Always"}, {"log": "AfterPipe"}},
+			logNotFound: expLog{{"log": "NotExecuted"}},
+			conf: `
+- name: Kodi command
+  pipe:
+  - name: Call Kodi
+    match:
+      string: a
+      value: b
+  - log:
+      msg: NotExecuted
+  rescue:
+  - response:
+      code: 502
+      body:
+        string: '=format("%v ''%v'' failed: %v", Failed.Predicate, Failed.Name, Failed.Error)'
+  always:
+  - log:
+      msg: Always
+- log:
+    msg: AfterPipe
+`,
+		},
+		{
+			name:        "NoRescue",
+			method:      http.MethodGet,
+			path:        "/NoRescue",
+			statusCode:  http.StatusOK,
+			logFound:    expLog{{"log": "Always"}},
+			logNotFound: expLog{{"log": "Rescue"}},
+			conf: `
+- pipe:
+  - match:
+      string: a
+      value: a
+  rescue:
+  - log:
+      msg: Rescue
+  always:
+  - log:
+      msg: Always
+`,
+		},
+		{
+			name:       "PredicateError",
+			method:     http.MethodGet,
+			path:       "/PredicateError",
+			statusCode: http.StatusInternalServerError,
+			want: "open /nonexistent/file.json: no such file or directory, " +
+				"readfile failed: open /nonexistent/file.json: no such file or directory",
+			logFound: expLog{{"log": "ErrorRegistered"}},
+			conf: `
+- pipe:
+  - readfile:
+      json: /nonexistent/file.json
+    register: file
+    result: '=R.file.error != ""'
+  - log:
+      msg: ErrorRegistered
+  - variable:
+      - error: =R.file.error
+  - readfile:
+      json: /nonexistent/file.json
+  rescue:
+  - response:
+      code: 500
+      body:
+        string: '=format("%v, %v failed: %v", V.error, Failed.Predicate, Failed.Error)'
+`,
+		},
+		{
+			name:       "Timeout",
+			method:     http.MethodGet,
+			path:       "/Timeout",
+			statusCode: http.StatusGatewayTimeout,
+			want:       "timeout after 50ms: Command killed: context deadline exceeded",
+			conf: `
+- pipe:
+  - command:
+      cmd: sleep
+      args: ["10"]
+    timeout: 50ms
+    register: sleep
+    result: '=R.sleep.error == ""'
+  rescue:
+  - response:
+      code: 504
+      body:
+        string: =R.sleep.error
+`,
+		},
+		{
+			name:       "Parallel",
+			method:     http.MethodGet,
+			path:       "/Parallel",
+			statusCode: http.StatusOK,
+			want:       "1 c 2 3",
+			conf: `
+- variable:
+    - c: 0
+- parallel:
+  - pipe:
+    - command:
+        cmd: sleep
+        args: ["0.1"]
+    - variable:
+        - a: 1
+  - match:
+      string: abc
+      regexp: b(c)
+    register: m
+  - variable:
+      - b: 2
+      - c: 3
+  - variable:
+      - d: 4
+- response:
+    body:
+      string: =format("%v %v %v %v", V.a, R.m.matches[1], V.b, V.c)
+`,
+		},
+		{
+			name:       "ParallelAny",
+			method:     http.MethodGet,
+			path:       "/ParallelAny",
+			statusCode: http.StatusOK,
+			want:       "any",
+			conf: `
+- parallel:
+  - match:
+      string: a
+      value: b
+  - match:
+      string: a
+      value: a
+  require: any
+- response:
+    body:
+      string: any
+`,
+		},
+		{
+			name:        "ParallelAll",
+			method:      http.MethodGet,
+			path:        "/ParallelAll",
+			statusCode:  http.StatusOK,
+			want:        "'parallel' is false",
+			logFound:    expLog{{"log": "Branch"}},
+			logNotFound: expLog{{"log": "NotExecuted"}},
+			conf: `
+- pipe:
+  - parallel:
+    - match:
+        string: a
+        value: b
+    - log:
+        msg: Branch
+  - log:
+      msg: NotExecuted
+  rescue:
+  - response:
+      body:
+        string: =Failed.Error
+`,
+		},
+		{
+			name:       "Call",
+			method:     http.MethodGet,
+			path:       "/Call",
+			statusCode: http.StatusOK,
+			want:       "Hello outer true outer",
+			conf: `
+- define:
+    name: greet
+    params:
+      who:
+      greeting: Hello
+    pipe:
+    - variable:
+      - x: inner
+      - msg: =format("%v %v", V.greeting, V.who)
+    return: =V.msg
+- variable:
+  - x: outer
+- call:
+    name: greet
+    args:
+      who: =V.x
+  register: g
+- response:
+    body:
+      string: =format("%v %v %v", R.g.value, R.g.result, V.x)
+`,
+		},
+		{
+			name:        "CallFalse",
+			method:      http.MethodGet,
+			path:        "/CallFalse",
+			statusCode:  http.StatusCreated,
+			want:        "callee",
+			logNotFound: expLog{{"log": "NotExecuted"}},
+			conf: `
+- define:
+    name: fail
+    pipe:
+    - response:
+        code: 201
+        body:
+          string: callee
+    - match:
+        string: a
+        value: b
+- call:
+    name: fail
+- log:
+    msg: NotExecuted
+`,
+		},
+		{
+			name:       "CallMissingParam",
+			method:     http.MethodGet,
+			path:       "/CallMissingParam",
+			statusCode: http.StatusOK,
+			want:       "Missing parameter 'p' for 'f'",
+			conf: `
+- define:
+    name: f
+    params: [p]
+    pipe: []
+- pipe:
+  - call:
+      name: f
+  rescue:
+  - response:
+      body:
+        string: =Failed.Error
+`,
+		},
+		{
+			name:       "CallRecursive",
+			method:     http.MethodGet,
+			path:       "/CallRecursive",
+			statusCode: http.StatusOK,
+			want:       "5 'call' is false",
+			conf: `
+- define:
+    name: count
+    params: [n]
+    pipe:
+    - variable:
+      - v: =V.n
+    - call:
+        name: count
+        args:
+          n: =V.n + 1
+      when: =V.n < 5
+      register: r
+    - variable:
+      - v: =R.r.value
+      when: =V.n < 5
+    return: =V.v
+- define:
+    name: infinite
+    pipe:
+    - call:
+        name: infinite
+- call:
+    name: count
+    args:
+      n: 1
+  register: c
+- pipe:
+  - call:
+      name: infinite
+  rescue:
+  - response:
+      body:
+        string: =format("%v %v", R.c.value, Failed.Error)
+`,
+		},
+		{
+			name:        "Stop",
+			method:      http.MethodGet,
+			path:        "/Stop",
+			statusCode:  http.StatusNotFound,
+			want:        "stopped",
+			logFound:    expLog{{"log": "Always"}, {"log": "Item a"}},
+			logNotFound: expLog{{"log": "NotExecuted"}, {"log": "Item b"}},
+			conf: `
+- pipe:
+  - pipe:
+    - log:
+        msg: =format("Item %v", Item)
+    - stop:
+        code: 404
+        body:
+          string: stopped
+      when: =Item == "a"
+    loop: [a, b]
+  - log:
+      msg: NotExecuted
+  always:
+  - log:
+      msg: Always
+- log:
+    msg: NotExecuted
+`,
+		},
+		{
+			name:        "StopInCall",
+			method:      http.MethodGet,
+			path:        "/StopInCall",
+			statusCode:  http.StatusOK,
+			logNotFound: expLog{{"log": "NotExecuted"}},
+			conf: `
+- define:
+    name: end
+    pipe:
+    - stop:
+- call:
+    name: end
+- log:
+    msg: NotExecuted
+`,
+		},
+		{
+			name:        "FirstMatch",
+			method:      http.MethodGet,
+			path:        "/FirstMatch",
+			statusCode:  http.StatusOK,
+			want:        "second",
+			logFound:    expLog{{"log": "NotAPipe"}},
+			logNotFound: expLog{{"log": "NotExecuted"}},
+			conf: `
+- options:
+    first_match: true
+- log:
+    msg: NotAPipe
+- pipe:
+  - match:
+      string: =In.URL.Path
+      value: /other
+  - response:
+      body:
+        string: first
+- pipe:
+  - match:
+      string: =In.URL.Path
+      value: /FirstMatch
+  - response:
+      body:
+        string: second
+- log:
+    msg: NotExecuted
+`,
+		},
+		{
+			name:        "Route",
+			method:      http.MethodGet,
+			path:        "/kodi/pause/12",
+			statusCode:  http.StatusOK,
+			want:        "pause 12",
+			logFound:    expLog{{"log": "Always 12"}},
+			logNotFound: expLog{{"log": "NotExecuted"}},
+			conf:        routesConf,
+		},
+		{
+			name:       "RouteStatic",
+			method:     http.MethodGet,
+			path:       "/kodi/play/12",
+			statusCode: http.StatusOK,
+			want:       "play 12",
+			conf:       routesConf,
+		},
+		{
+			name:       "RouteNotFound",
+			method:     http.MethodGet,
+			path:       "/kodi/play",
+			statusCode: http.StatusNotFound,
+			want:       "Not Found",
+			conf:       routesConf,
+		},
+		{
+			name:        "RouteNotAllowed",
+			method:      http.MethodDelete,
+			path:        "/kodi/play/12",
+			statusCode:  http.StatusMethodNotAllowed,
+			want:        "Method Not Allowed",
+			wantHeaders: map[string]string{"Allow": "GET, POST"},
+			conf:        routesConf,
+		},
+		{
+			name:       "RouteNested",
+			method:     http.MethodGet,
+			path:       "/RouteNested",
+			statusCode: http.StatusOK,
+			want:       "'route' can only be set on a top-level pipe",
+			conf: `
+- pipe:
+  - route: /RouteNested
+    pipe: []
+  rescue:
+  - response:
+      body:
+        string: =Failed.Error
 `,
 		},
 	}
@@ -413,9 +1006,7 @@ func TestFullConf(t *testing.T) {
 				zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
 			}
-			config = getConf(t, tc.conf)
-			staticCtx = ctx.New()
-			processInit(&config, staticCtx)
+			load(&conf.Config{Root: getConf(t, tc.conf)})
 			request := httptest.NewRequest(tc.method, tc.path,
 				bytes.NewBuffer([]byte(tc.body)))
 			if tc.mime != "" {
@@ -450,15 +1041,817 @@ func TestFullConf(t *testing.T) {
 				t.Errorf("Want '%s', got '%s'",
 					tc.want, responseRecorder.Body)
 			}
+			for k, v := range tc.wantHeaders {
+				if h := responseRecorder.Header().Get(k); h != v {
+					t.Errorf("Want header %s '%s', got '%s'",
+						k, v, h)
+				}
+			}
+		})
+	}
+}
+
+// A request that times out or whose caller is gone must cancel the
+// predicate being evaluated and skip the following ones
+func TestRequestCancelled(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	load(&conf.Config{Root: getConf(t, `
+- pipe:
+  - command:
+      cmd: sleep
+      args: ["10"]
+  rescue:
+  - variable:
+      - error: =Failed.Error
+  - log:
+      msg: NotEvaluated
+  - response:
+      body:
+        string: =V.error
+`)})
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+
+	requestTimeout = 50 * time.Millisecond
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	start := time.Now()
+	handler(responseRecorder, request)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	// response is not set, as the request is done
+	assert.Equal(t, "", responseRecorder.Body.String())
+
+	requestTimeout = 0
+	gc, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := current.Load().(*state).ctx.Fork()
+	process(httptest.NewRecorder(), request.WithContext(gc),
+		current.Load().(*state), c)
+	assert.Equal(t, "Request is done: context canceled", c.Failed.Error)
+}
+
+// Values of the incoming request available in Req
+func TestRequestView(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	load(&conf.Config{Root: getConf(t, `
+- response:
+    body:
+      string: >-
+        =format("%v|%v|%v|%v|%v|%v|%v|%v|%v", Req.Method, Req.Path,
+        Req.Query("lang"), Req.Query("none"), Req.Form("f"),
+        Req.Cookie("session"), Req.Header("x-custom"), Req.Body(),
+        Req.RemoteIP)
+`)})
+	defer func(n []*net.IPNet) { trustedNetworks = n }(trustedNetworks)
+
+	tt := []struct {
+		name    string
+		trusted string
+		want    string
+	}{
+		{
+			name: "NoProxy",
+			want: "POST|[kodi play]|en||a|s1|v|f=a|10.0.0.2",
+		},
+		{
+			name:    "Proxy",
+			trusted: "10.0.0.0/24, 192.168.1.1",
+			want:    "POST|[kodi play]|en||a|s1|v|f=a|192.168.2.1",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var err error
+			trustedNetworks, err = ctx.ParseNetworks(tc.trusted)
+			require.Nil(t, err)
+			request := httptest.NewRequest(http.MethodPost,
+				"/kodi/play?lang=en", bytes.NewBufferString("f=a"))
+			request.RemoteAddr = "10.0.0.2:1234"
+			request.Header.Set("Content-Type",
+				"application/x-www-form-urlencoded")
+			request.Header.Set("X-Custom", "v")
+			request.Header.Set("X-Forwarded-For", "1.2.3.4, 192.168.2.1")
+			request.Header.Add("X-Forwarded-For", "192.168.1.1")
+			request.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+			responseRecorder := httptest.NewRecorder()
+			handler(responseRecorder, request)
+			assert.Equal(t, tc.want, responseRecorder.Body.String())
 		})
 	}
+
+	_, err := ctx.ParseNetworks("10.0.0.0/33")
+	assert.NotNil(t, err)
+}
+
+// The body of the requests is limited by -max-body-size, for all the
+// predicates
+func TestMaxBodySize(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	defer func(n int64) { maxBodySize = n }(maxBodySize)
+	for _, tc := range []struct {
+		size int64
+		want string
+	}{
+		{0, "0123456789 0123456789"},
+		{10, "0123456789 0123456789"},
+		{4, ""},
+	} {
+		maxBodySize = tc.size
+		load(&conf.Config{Root: getConf(t, `
+- body: {type: string}
+  register: b
+- variable:
+    - body: =Req.Body()
+- response:
+    body:
+      string: =R.b.payload + " " + V.body
+`)})
+		request := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader("0123456789"))
+		responseRecorder := httptest.NewRecorder()
+		handler(responseRecorder, request)
+		assert.Equal(t, tc.want, responseRecorder.Body.String(),
+			"size %v", tc.size)
+	}
+}
+
+// The response must be sent without waiting for the async pipe, which
+// is evaluated with a snapshot of the context
+func TestAsync(t *testing.T) {
+	tst := zltest.New(t)
+	log.Logger = zerolog.New(tst).With().Timestamp().Logger()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	predicate.StartAsync(2, 10)
+	load(&conf.Config{Root: getConf(t, `
+- variable:
+    - x: initial
+- response:
+    body:
+      string: accepted
+- async: true
+  pipe:
+  - command:
+      cmd: sleep
+      args: ["0.2"]
+  - log:
+      msg: =format("done %v", V.x)
+  - response:
+      body:
+        string: ignored
+- variable:
+    - x: changed
+`)})
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("X-Request-Id", "test-id")
+	responseRecorder := httptest.NewRecorder()
+	start := time.Now()
+	handler(responseRecorder, request)
+	assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	assert.Equal(t, "accepted", responseRecorder.Body.String())
+	assert.Equal(t, "test-id", responseRecorder.Header().Get("X-Request-Id"))
+
+	predicate.WaitAsync()
+	found := false
+	for _, e := range tst.Entries().Get() {
+		if msg, _ := e.Str("log"); msg == "done initial" {
+			found = true
+			e.ExpStr("request", "test-id")
+		}
+	}
+	assert.True(t, found, "async pipe not evaluated")
+}
+
+// Branches of 'parallel' must be evaluated at the same time, unless
+// 'limit' is set
+func TestParallelLimit(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	for _, tc := range []struct {
+		limit    int
+		min, max time.Duration
+	}{
+		{0, 0, 250 * time.Millisecond},
+		{1, 300 * time.Millisecond, 10 * time.Second},
+	} {
+		load(&conf.Config{Root: getConf(t, fmt.Sprintf(`
+- parallel:
+  - command: {cmd: sleep, args: ["0.1"]}
+  - command: {cmd: sleep, args: ["0.1"]}
+  - command: {cmd: sleep, args: ["0.1"]}
+  limit: %v
+`, tc.limit))})
+		start := time.Now()
+		handler(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/", nil))
+		d := time.Since(start)
+		assert.True(t, d >= tc.min && d < tc.max,
+			"limit %v: unexpected duration %v", tc.limit, d)
+	}
+}
+
+// Branches of 'parallel' must read the body of the request with their
+// own reader. Must be run with -race.
+func TestParallelBody(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	load(&conf.Config{Root: getConf(t, `
+- parallel:
+  - body: {type: json}
+    register: b1
+  - body: {type: string}
+    register: b2
+  - variable:
+      - form: =Req.Form("k")
+- response:
+    body:
+      string: =format("%v %v %v", R.b1.payload.k, R.b2.payload, V.form)
+`)})
+	for i := 0; i < 10; i++ {
+		request := httptest.NewRequest(http.MethodPost, "/?k=q",
+			strings.NewReader(`{"k":"v"}`))
+		responseRecorder := httptest.NewRecorder()
+		handler(responseRecorder, request)
+		assert.Equal(t, `v {"k":"v"} q`, responseRecorder.Body.String())
+	}
+}
+
+// Fire parallel requests on the same conf and check that each of them
+// only sees its own variables & registered results. Must be run with
+// -race to detect concurrent accesses to shared data.
+func TestConcurrentRequests(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().Caller().Timestamp().Logger()
+	load(&conf.Config{Root: getConf(t, `
+- init:
+    - variable:
+        - prefix: id
+    - match:
+        string: "BBBAAABBB"
+        regexp: "B(A+)B"
+      register: init
+    - default:
+        match:
+          regexp: "^[0-9]+$"
+
+- name: "Concurrent"
+  pipe:
+    - variable:
+        - id: '=In.URL.Query()|key[0]'
+    - default:
+        match:
+          string: =V.id
+    - match: {}
+      register: match
+    - variable:
+        - value: '=V.prefix + R.init.matches[1] + R.match.matches[0]'
+    - response:
+        body:
+          string: =V.value
+`)})
+	staticCtx := current.Load().(*state).ctx
+
+	const n = 100
+	var wg sync.WaitGroup
+	errs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := httptest.NewRequest(http.MethodGet,
+				fmt.Sprintf("/Concurrent?key=%d", i), nil)
+			responseRecorder := httptest.NewRecorder()
+			handler(responseRecorder, request)
+			want := fmt.Sprintf("idAAA%d", i)
+			if got := responseRecorder.Body.String(); got != want {
+				errs <- fmt.Sprintf("Want '%s', got '%s'", want, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	// requests must not modify the context set by init
+	assert.Equal(t, ctx.Variables{"prefix": "id"}, staticCtx.V)
+	assert.Equal(t, 1, len(staticCtx.R))
+	assert.Equal(t, ctx.Default{
+		"match": ctx.DefaultParams{"regexp": "^[0-9]+$"},
+	}, staticCtx.Default)
+}
+
+func TestReload(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().Caller().Timestamp().Logger()
+	dir, err := ioutil.TempDir("", "genapid")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	main := filepath.Join(dir, "api.yml")
+	inc := filepath.Join(dir, "inc.yml")
+	date := time.Now()
+	write := func(file, content string) {
+		require.Nil(t, ioutil.WriteFile(file, []byte(content), 0600))
+		// make sure modification is seen, whatever the
+		// resolution of the filesystem
+		date = date.Add(time.Second)
+		require.Nil(t, os.Chtimes(file, date, date))
+	}
+	body := func() string {
+		request := httptest.NewRequest(http.MethodGet, "/Reload", nil)
+		responseRecorder := httptest.NewRecorder()
+		handler(responseRecorder, request)
+		return responseRecorder.Body.String()
+	}
+	response := func(s string) string {
+		return `
+- response:
+    body:
+      string: ` + s + "\n"
+	}
+
+	write(inc, response("=V.version"))
+	write(main, `
+- init:
+    - variable:
+        - version: v1
+- include: `+inc+"\n")
+	configFileName = main
+	require.True(t, reload(), "initial conf")
+	assert.Equal(t, []string{main, inc}, current.Load().(*state).files)
+	assert.Equal(t, "v1", body())
+	assert.Contains(t, current.Load().(*state).ctx.Expressions, "=V.version",
+		"expressions compiled with the conf")
+
+	done := make(chan struct{})
+	defer close(done)
+	watch(10*time.Millisecond, done)
+
+	// Change in main file, init is evaluated again
+	write(main, `
+- init:
+    - variable:
+        - version: v2
+- include: `+inc+"\n")
+	assert.Eventually(t, func() bool { return body() == "v2" },
+		2*time.Second, 10*time.Millisecond, "main file not reloaded")
+
+	// Change in included file
+	write(inc, response("v3"))
+	assert.Eventually(t, func() bool { return body() == "v3" },
+		2*time.Second, 10*time.Millisecond, "include not reloaded")
+
+	// Invalid conf, current one is kept
+	write(inc, "- response: [")
+	assert.False(t, reload(), "invalid conf")
+	assert.Equal(t, "v3", body())
+	write(main, "- include: "+filepath.Join(dir, "none.yml"))
+	assert.False(t, reload(), "missing include")
+	assert.Equal(t, "v3", body())
+}
+
+// A change of 'server' is not applied on reload, but logged
+func TestReloadServer(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	f, err := ioutil.TempFile("", "genapid*.yml")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("- server:\n    request_timeout: 5s\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	configFileName = f.Name()
+	defer func() { startServer = server{} }()
+
+	const warning = "'server' changed, restart genapid to apply it"
+	for _, tc := range []struct {
+		start   server
+		changed bool
+	}{
+		{server{RequestTimeout: 5 * time.Second}, false},
+		{server{RequestTimeout: time.Second}, true},
+	} {
+		tst := zltest.New(t)
+		log.Logger = zerolog.New(tst)
+		startServer = tc.start
+		require.True(t, reload())
+		if tc.changed {
+			tst.Entries().ExpMsg(warning)
+		} else {
+			tst.Entries().NotExpMsg(warning)
+		}
+	}
+}
+
+// On shutdown, running requests & async predicates are waited for,
+// up to the timeout, before 'shutdown' is evaluated
+func TestShutdown(t *testing.T) {
+	tst := zltest.New(t)
+	log.Logger = zerolog.New(tst).With().Timestamp().Logger()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	predicate.StartAsync(2, 10)
+	load(&conf.Config{Root: getConf(t, `
+- shutdown:
+    - log:
+        msg: =format("shutdown %v", V.x)
+- init:
+    - variable:
+        - x: init
+- async: true
+  pipe:
+  - command:
+      cmd: sleep
+      args: ["0.3"]
+  - log:
+      msg: async done
+- command:
+    cmd: sleep
+    args: ['=Req.Query("sleep")']
+- response:
+    body:
+      string: done
+`)})
+	serve := func() (*http.Server, string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		srv := &http.Server{Handler: http.HandlerFunc(handler)}
+		go srv.Serve(ln) // nolint:errcheck
+		return srv, "http://" + ln.Addr().String()
+	}
+	get := func(url string, body chan<- string) {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body <- string(b)
+	}
+	logs := func() []string {
+		l := []string{}
+		for _, e := range tst.Entries().Get() {
+			if msg, s := e.Str("log"); s == zltest.KeyFound {
+				l = append(l, msg)
+			}
+		}
+		return l
+	}
+
+	srv, url := serve()
+	body := make(chan string, 1)
+	go get(url+"/?sleep=0.2", body)
+	time.Sleep(100 * time.Millisecond) // request is running
+	shutdown(srv, current.Load().(*state), 5*time.Second)
+	assert.Equal(t, "done", <-body)
+	assert.Equal(t, []string{"async done", "shutdown init"}, logs())
+	_, err := http.Get(url)
+	assert.NotNil(t, err, "new connections are refused")
+
+	// requests still running after the timeout are cancelled
+	predicate.StartAsync(2, 10)
+	srv, url = serve()
+	go get(url+"/?sleep=10", body)
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	shutdown(srv, current.Load().(*state), 50*time.Millisecond)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.NotEqual(t, "done", <-body)
+	assert.Equal(t, "shutdown init", logs()[len(logs())-1])
+	assert.Len(t, logs(), 3)
+	predicate.StartAsync(2, 10)
+}
+
+// Settings of the 'server' statement are validated, and overridden
+// by command line flags & environment variables
+func TestServer(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	node := func(source string) *yaml.Node {
+		var doc yaml.Node
+		require.Nil(t, yaml.Unmarshal([]byte(source), &doc))
+		return doc.Content[0]
+	}
+
+	errs := parseServer(node(`
+listen: unix:/run/genapid.sock
+port: 70000
+read_timeout: 10
+write_timeout: 5s
+base_path: api
+trusted_proxies: 10.0.0.0/8,nope
+log_format: xml
+max_body_size: [1]
+max_header_size: 1e3
+tiemout: 1s
+`))
+	want := []string{
+		"3:7: 'port': failed on 'lte' validation",
+		"4:15: 'read_timeout': invalid value",
+		"6:12: 'base_path': failed on 'startswith' validation",
+		"7:18: 'trusted_proxies': invalid IP address 'nope'",
+		"8:13: 'log_format': failed on 'oneof' validation",
+		"9:16: 'max_body_size': invalid value",
+		// valid YAML int, but not accepted by the flag
+		"10:18: 'max_header_size': invalid value",
+		"11:1: unknown setting 'tiemout' for 'server'",
+	}
+	if assert.Len(t, errs, len(want)) {
+		for i, e := range errs {
+			assert.Equal(t, want[i], e.Error())
+		}
+	}
+	assert.Len(t, parseServer(node("listen: 127.0.0.1:8080")), 0)
+	assert.Len(t, parseServer(node("listen: nope")), 1)
+	assert.Len(t, parseServer(node("[port]")), 1)
+
+	var port int
+	var level string
+	var timeout time.Duration
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.IntVar(&port, "port", 9110, "")
+	fs.StringVar(&level, "loglevel", "info", "")
+	fs.DurationVar(&timeout, "read-timeout", 0, "")
+	fs.StringVar(&basePath, "base-path", "", "")
+	require.Nil(t, fs.Parse([]string{"-port", "1"}))
+	defer os.Unsetenv("GENAPID_LOGLEVEL")
+	defer os.Unsetenv("GENAPID_PORT")
+	require.Nil(t, os.Setenv("GENAPID_LOGLEVEL", "debug"))
+	require.Nil(t, os.Setenv("GENAPID_PORT", "2"))
+	set, err := envFlags(fs)
+	require.Nil(t, err)
+	require.Nil(t, applyServer(fs, node(`
+port: 3
+log_level: warn
+read_timeout: 5s
+`), set))
+	assert.Equal(t, 1, port, "command line first")
+	assert.Equal(t, "debug", level, "then environment")
+	assert.Equal(t, 5*time.Second, timeout, "then conf")
+	assert.Equal(t, "", basePath, "default")
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.DurationVar(&timeout, "read-timeout", 0, "")
+	require.Nil(t, os.Setenv("GENAPID_READ_TIMEOUT", "x"))
+	defer os.Unsetenv("GENAPID_READ_TIMEOUT")
+	_, err = envFlags(fs)
+	assert.NotNil(t, err, "invalid environment variable")
+}
+
+// Requests are received on a UNIX socket, with the base path removed
+func TestListen(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	dir, err := ioutil.TempDir("", "genapid")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(addr string) { listenAddr = addr }(listenAddr)
+
+	load(&conf.Config{Root: getConf(t, `
+- server:
+    base_path: /api/
+- response:
+    body:
+      string: =In.URL.Path
+`)})
+	socket := filepath.Join(dir, "genapid.sock")
+	listenAddr = "unix:" + socket
+	// socket left by a previous run is replaced
+	ln, err := net.Listen("unix", socket)
+	require.Nil(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listener()
+	require.Nil(t, err)
+	srv := &http.Server{Handler: stripPrefix("/api/",
+		http.HandlerFunc(handler))}
+	go srv.Serve(ln) // nolint:errcheck
+	defer srv.Close()
+	// socket used by a running one is kept
+	_, err = listener()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "address in use")
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(gc context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(gc, "unix", socket)
+		}}}
+	get := func(path string) (int, string) {
+		resp, err := c.Get("http://genapid" + path)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return resp.StatusCode, string(b)
+	}
+	code, body := get("/api/a/b")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "/a/b", body)
+	_, body = get("/api")
+	assert.Equal(t, "/", body)
+	code, _ = get("/apix")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/a/b")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// HTTPS with a certificate reloaded when modified, and client
+// certificates
+func TestTLS(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	dir, err := ioutil.TempDir("", "genapid")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(cert, key, ca, auth string) {
+		tlsCert, tlsKey, tlsClientCA, tlsClientAuth = cert, key, ca, auth
+	}(tlsCert, tlsKey, tlsClientCA, tlsClientAuth)
+
+	ca := newTestCert(t, nil, "CA")
+	ca.write(t, dir, "ca")
+	server := newTestCert(t, ca, "server1")
+	tlsCert, tlsKey = server.write(t, dir, "server")
+	client := newTestCert(t, ca, "client")
+	tlsClientCA, _ = ca.write(t, dir, "ca")
+
+	tlsClientAuth = "none"
+	_, _, err = tlsConfig()
+	assert.NotNil(t, err, "invalid -tls-client-auth")
+	tlsClientAuth = "optional"
+	cfg, cert, err := tlsConfig()
+	require.Nil(t, err)
+	require.NotNil(t, cert)
+
+	load(&conf.Config{Root: getConf(t, `
+- response:
+    body:
+      string: =format("client '%v'", Req.ClientCert)
+`)})
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.Nil(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(handler)}
+	go srv.Serve(ln) // nolint:errcheck
+	defer srv.Close()
+
+	get := func(clientCert *testCert) (string, string) {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		tlsCfg := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+		if clientCert != nil {
+			tlsCfg.Certificates = []tls.Certificate{clientCert.pair()}
+		}
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: tlsCfg, DisableKeepAlives: true}}
+		resp, err := c.Get("https://" + ln.Addr().String())
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b), resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	body, cn := get(client)
+	assert.Equal(t, "client 'client'", body)
+	assert.Equal(t, "server1", cn)
+	body, _ = get(nil)
+	assert.Equal(t, "client ''", body, "optional client certificate")
+
+	// new certificate is used without restart
+	server = newTestCert(t, ca, "server2")
+	server.write(t, dir, "server")
+	date := time.Now().Add(time.Second)
+	require.Nil(t, os.Chtimes(tlsCert, date, date))
+	cert.reload()
+	_, cn = get(client)
+	assert.Equal(t, "server2", cn)
+
+	// invalid certificate is not loaded
+	require.Nil(t, ioutil.WriteFile(tlsKey, []byte("invalid"), 0600))
+	require.Nil(t, os.Chtimes(tlsKey, date, date.Add(time.Second)))
+	cert.reload()
+	_, cn = get(client)
+	assert.Equal(t, "server2", cn)
+
+	tlsCert = ""
+	_, _, err = tlsConfig()
+	assert.NotNil(t, err, "-tls-key without -tls-cert")
+}
+
+// ACME certificates are requested to the server set with
+// -acme-directory, only for the domains set with -acme-domains
+func TestACME(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	dir, err := ioutil.TempDir("", "genapid")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(domains, cache, directory, ca string) {
+		acmeDomains, acmeCache, acmeDirectory, acmeCA =
+			domains, cache, directory, ca
+	}(acmeDomains, acmeCache, acmeDirectory, acmeCA)
+
+	// stand-in of the ACME server, which fails all the requests
+	var hits int32
+	acmeServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"type":"urn:ietf:params:acme:error:unauthorized"}`)
+		}))
+	defer acmeServer.Close()
+	acmeCA = filepath.Join(dir, "acme-ca.pem")
+	require.Nil(t, ioutil.WriteFile(acmeCA, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: acmeServer.Certificate().Raw}), 0600))
+	acmeDirectory = acmeServer.URL + "/directory"
+	acmeCache = filepath.Join(dir, "cache")
+	acmeDomains = "example.com, www.example.com"
+
+	cfg, cert, err := tlsConfig()
+	require.Nil(t, err)
+	assert.Nil(t, cert)
+	assert.Contains(t, cfg.NextProtos, acme.ALPNProto)
+
+	_, err = cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.com"})
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits), "domain not allowed")
+
+	_, err = cfg.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:        "www.example.com",
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	assert.NotNil(t, err)
+	assert.NotEqual(t, int32(0), atomic.LoadInt32(&hits), "ACME server called")
+
+	tlsCert, tlsKey = "cert.pem", "key.pem"
+	defer func() { tlsCert, tlsKey = "", "" }()
+	_, _, err = tlsConfig()
+	assert.NotNil(t, err, "ACME & certificate files")
+}
+
+// The examples shipped with genapid must pass the check
+func TestCheckExamples(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	defer os.Chdir(wd) // nolint:errcheck
+	for _, file := range []string{
+		"../../examples/github/github.yml",
+		"../../examples/kodi/kodi.yml",
+	} {
+		// included files are relative to the directory of the
+		// example
+		require.Nil(t, os.Chdir(filepath.Join(wd, filepath.Dir(file))))
+		cfg, err := conf.ReadConfFile(filepath.Base(file))
+		require.Nil(t, err, file)
+		assert.Empty(t, check(cfg), file)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	cfg, err := conf.ReadConfFile("testdata/check_ok.yml")
+	require.Nil(t, err)
+	assert.Empty(t, check(cfg))
+
+	cfg, err = conf.ReadConfFile("testdata/check.yml")
+	require.Nil(t, err)
+	errs := check(cfg)
+	want := []string{
+		"check.yml:5:7: Unknown predicate 'unknown'",
+		"check.yml:15:9: 'value': failed on 'excluded_with' validation",
+		"check.yml:16:9: 'regexp': failed on 'excluded_with' validation",
+		"check.yml:18:9: 'url': failed on 'url' validation",
+		"check.yml:19:9: 'method': failed on 'oneof' validation",
+		"check.yml:20:9: 'tiemout': unknown parameter for 'http'",
+		"check.yml:22:9: 'port': 'Port' expected type 'int'",
+		"check.yml:25:14: invalid expression",
+		"check.yml:26:13: invalid expression",
+		"check.yml:28:9: Unknown predicate 'nope' in 'default'",
+		"check_include.yml:1:3: invalid 'register'",
+		"check_include.yml:8:7: Unknown predicate 'msg'",
+		"check.yml:34:14: invalid expression",
+		"check.yml:35:7: invalid 'timeout'",
+		"check.yml:39:5: Unknown pipe 'nothing' in 'call'",
+		"check.yml:44:16: invalid expression",
+		"check.yml:46:5: unknown option 'first'",
+		"check.yml:48:5: 'code': failed on 'gte' validation",
+		"check.yml:51:10: route 'GET /a/{x}' already defined",
+		"check.yml:53:14: 'route' can only be set on a top-level pipe",
+		"check.yml:55:3: invalid 'route': invalid method 'get'",
+		"check.yml:59:14: invalid expression",
+		"check.yml:60:3: 'shutdown' set several times",
+		"check.yml:62:11: 'port': failed on 'gte' validation",
+		"check.yml:63:5: unknown setting 'log' for 'server'",
+	}
+	if assert.Len(t, errs, len(want)) {
+		for i, e := range errs {
+			assert.True(t, strings.HasPrefix(
+				e.Error(), filepath.Join("testdata", want[i])),
+				"got %v, want %v", e, want[i])
+		}
+	}
 }
 
 /***************************************************************************
   Benchmarck: compare predicates with and without gval
   ***************************************************************************/
 func BenchmarkNoGval(b *testing.B) {
-	conf := `
+	source := `
 - name: "Test simple pipe of match without expressions"
   pipe:
   - match:
@@ -473,7 +1866,7 @@ func BenchmarkNoGval(b *testing.B) {
       value: AAAB
 `
 	zerolog.SetGlobalLevel(logLevel)
-	config = getConfB(b, conf)
+	load(&conf.Config{Root: getConfB(b, source)})
 	request := httptest.NewRequest(http.MethodGet, "/bench", nil)
 	responseRecorder := httptest.NewRecorder()
 	for i := 0; i < b.N; i++ {
@@ -482,7 +1875,7 @@ func BenchmarkNoGval(b *testing.B) {
 
 }
 func BenchmarkWithGval(b *testing.B) {
-	conf := `
+	source := `
 - name: "Test simple pipe of match with expressions"
   pipe:
   - match:
@@ -497,7 +1890,7 @@ func BenchmarkWithGval(b *testing.B) {
       value: AAAB
 `
 	zerolog.SetGlobalLevel(zerolog.FatalLevel)
-	config = getConfB(b, conf)
+	load(&conf.Config{Root: getConfB(b, source)})
 	request := httptest.NewRequest(http.MethodGet, "/bench", nil)
 	responseRecorder := httptest.NewRecorder()
 	for i := 0; i < b.N; i++ {
@@ -505,6 +1898,31 @@ func BenchmarkWithGval(b *testing.B) {
 	}
 }
 
+// Full request on the kodi example, with a phrase that is matched
+// against all the actions
+func BenchmarkKodi(b *testing.B) {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+	wd, err := os.Getwd()
+	require.Nil(b, err)
+	defer func() { require.Nil(b, os.Chdir(wd)) }()
+	// included files are relative to the example directory, but
+	// the files read by readfile are relative to the repository
+	require.Nil(b, os.Chdir("../../examples/kodi"))
+	cfg, err := conf.ReadConfFile("kodi.yml")
+	require.Nil(b, err)
+	load(cfg)
+	require.Nil(b, os.Chdir("../.."))
+
+	body := `{"token":"secretToken"}`
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := httptest.NewRequest(http.MethodPost,
+			"/ifttt?lang=en&phrase=hello+world", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		handler(httptest.NewRecorder(), request)
+	}
+}
+
 /***************************************************************************
   Helpers
   ***************************************************************************/
@@ -521,3 +1939,56 @@ func getConfB(b *testing.B, source string) conf.Root {
 	require.Nil(b, yaml.Unmarshal([]byte(source), &c))
 	return c
 }
+
+// testCert is a certificate & its key, used by TLS tests
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Returns a new certificate for name, signed by ca, self-signed CA if
+// ca is nil
+func newTestCert(t *testing.T, ca *testCert, name string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent,
+		&key.PublicKey, signer)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+// Writes the certificate & key in PEM files in dir, returns their names
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	k, err := x509.MarshalECPrivateKey(c.key)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	require.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: k}), 0600))
+	return certFile, keyFile
+}
+
+func (c *testCert) pair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
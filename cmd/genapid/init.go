@@ -36,9 +36,16 @@ func processInit(cfg *conf.Root, c *ctx.Ctx) {
 		return
 	}
 	log.Info().Msg("Processing init")
+	processList(predicates, c)
+	// 'stop' only ends 'init', not the requests
+	c.Stopped = false
+}
+
+// Evaluate predicates in c until one is false or 'stop' is evaluated
+func processList(predicates initValues, c *ctx.Ctx) {
 	for j := 0; j < len(predicates); j++ {
 		result := predicate.Process(log.Logger, &predicates[j], c)
-		if !result {
+		if !result || c.Stopped {
 			break
 		}
 	}
@@ -5,14 +5,22 @@
 package main
 
 import (
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/jsautret/genapid/app/conf"
 	"github.com/jsautret/genapid/app/plugins"
+	"github.com/jsautret/genapid/app/predicate"
+	"github.com/jsautret/genapid/app/router"
 	"github.com/jsautret/genapid/ctx"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -26,53 +34,133 @@ var (
 	buildSource  = "compiled"
 )
 
-var (
-	// Global conf
+// state is a loaded conf with the context set by its 'init'
+type state struct {
 	config conf.Root
-	// main context
-	staticCtx *ctx.Ctx
-)
+	// main context, set by 'init' and never modified afterwards
+	ctx *ctx.Ctx
+	// conf files, watched for changes
+	files []string
+	// set by the 'options' statement of the conf
+	options options
+	// 'route' options of the top-level pipes, nil if none
+	router *router.Router
+	// predicates of the 'shutdown' statement
+	shutdown initValues
+	// maximum size of the body of the requests, 0 for no limit
+	maxBodySize int64
+}
+
+// current *state, replaced when the conf is reloaded
+var current atomic.Value
 
 // Command line flags variables
 var (
-	configFileName string
-	SLogLevel      string
-	port           int
-	versionFlag    bool
+	configFileName  string
+	SLogLevel       string
+	port            int
+	versionFlag     bool
+	watchInterval   time.Duration
+	metricsPath     string
+	requestTimeout  time.Duration
+	asyncWorkers    int
+	asyncQueue      int
+	trustedProxies  string
+	shutdownTimeout time.Duration
 )
 
+// Networks of the proxies set by -trusted-proxies
+var trustedNetworks []*net.IPNet
+
 // Command line flags definitions
 func init() {
 	flag.StringVar(&configFileName, "config", "api.yml", "Config file")
 	flag.StringVar(&SLogLevel, "loglevel", "info", "Log level")
 	flag.IntVar(&port, "port", 9110, "Listening port")
 	flag.BoolVar(&versionFlag, "version", false, "prints current version and exit")
+	flag.DurationVar(&watchInterval, "watch", 2*time.Second,
+		"Interval between checks of config files changes, 0 to disable")
+	flag.StringVar(&metricsPath, "metrics", "",
+		"Path serving the metrics in expvar JSON format, e.g. /debug/vars")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0,
+		"Maximum duration of the processing of a request, 0 for no limit")
+	flag.IntVar(&asyncWorkers, "async-workers", 4,
+		"Number of async predicates evaluated at the same time")
+	flag.IntVar(&asyncQueue, "async-queue", 100,
+		"Maximum number of async predicates waiting to be evaluated")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "",
+		"Comma separated IP addresses or networks of the proxies allowed to set X-Forwarded-For")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second,
+		"Maximum duration of the wait for requests & async predicates on SIGTERM or SIGINT, 0 for no limit")
+	tlsFlags()
+	serverFlags()
 }
 
 // Main handler for incoming requests
 func handler(w http.ResponseWriter, r *http.Request) {
-	process(w, r, staticCtx)
+	s := current.Load().(*state)
+	// each request gets its own context, so concurrent requests
+	// don't see each other's variables & registered results
+	process(w, r, s, s.ctx.Fork())
 }
 
-func version() {
-	fmt.Printf("genapid %s %s on %s\ncommit %s\n",
-		buildVersion, buildSource, buildDate, buildCommit)
+// Log each problem found in conf files
+func logConfError(err error) {
+	var errs conf.Errors
+	if !errors.As(err, &errs) {
+		log.Error().Err(err).Msg("")
+		return
+	}
+	for _, e := range errs {
+		log.Error().Err(e.Err).Str("file", e.File).
+			Int("line", e.Line).Int("column", e.Column).Msg("")
+	}
 }
 
-func main() {
-	flag.Parse()
-
-	if versionFlag {
-		version()
-		os.Exit(0)
+// Evaluate 'init' of the conf and make it the current one
+func load(cfg *conf.Config) {
+	s := &state{
+		config:      cfg.Root,
+		ctx:         ctx.New(),
+		files:       cfg.Files,
+		maxBodySize: maxBodySize,
 	}
+	// dropped with the state when the conf is reloaded
+	s.ctx.Expressions = cfg.Expressions
+	// 'define', 'options', 'shutdown' & 'server' may be set before
+	// 'init'
+	predicate.Define(log.Logger, &s.config, s.ctx)
+	s.options = processOptions(&s.config)
+	s.shutdown = processShutdown(&s.config)
+	processServer(&s.config)
+	processInit(&s.config, s.ctx)
+	s.router = predicate.Routes(log.Logger, s.config)
+	current.Store(s)
+}
 
+// Logger before setLog, as it may be called several times
+var defaultLogger = log.Logger
+
+// Set the log output & level from -log-format & -loglevel
+func setLog() {
 	// UNIX Time is faster and smaller than most timestamps
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	if fileInfo, _ := os.Stdout.Stat(); (fileInfo.Mode() & os.ModeCharDevice) != 0 {
+	console := logFormat == "console"
+	if logFormat == "auto" {
+		fileInfo, _ := os.Stdout.Stat()
 		// sdtout is console
+		console = (fileInfo.Mode() & os.ModeCharDevice) != 0
+	}
+	log.Logger = defaultLogger
+	if console {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
+	switch logFormat {
+	case "auto", "console", "json":
+	default:
+		log.Warn().Str("format", logFormat).Msg("Unknown log format, using json")
+	}
+
 	if logLevel, err := zerolog.ParseLevel(SLogLevel); err != nil {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 		log.Warn().Err(err).Msg("Forcing info log level")
@@ -83,10 +171,79 @@ func main() {
 		}
 		log.Info().Str("loglevel", logLevel.String()).Msg("Setting loglevel")
 	}
+}
 
-	config = conf.ReadConfFile(configFileName)
-	staticCtx = ctx.New()
-	processInit(&config, staticCtx)
+func version() {
+	fmt.Printf("genapid %s %s on %s\ncommit %s\n",
+		buildVersion, buildSource, buildDate, buildCommit)
+}
+
+func main() {
+	flag.Parse()
+
+	if versionFlag {
+		version()
+		os.Exit(0)
+	}
+
+	checkCmd := false
+	switch flag.Arg(0) {
+	case "":
+	case "check":
+		checkCmd = true
+		// flags may also be set after the command
+		if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%v'\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// flags set on the command line or by environment variables
+	set, err := envFlags(flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	setLog()
+
+	if checkCmd {
+		os.Exit(runCheck())
+	}
+
+	cfg, err := conf.ReadConfFile(configFileName)
+	if err != nil {
+		logConfError(err)
+		log.Fatal().Msg("Cannot read conf")
+	}
+	if n := serverStatement(cfg.Root); n != nil {
+		if errs := parseServer(n); len(errs) > 0 {
+			for _, e := range errs {
+				e.File = cfg.FileOf(n, configFileName)
+			}
+			logConfError(errs)
+			log.Fatal().Msg("Invalid 'server'")
+		}
+		if err := applyServer(flag.CommandLine, n, set); err != nil {
+			log.Fatal().Err(err).Msg("Invalid 'server'")
+		}
+		startServer = decodeServer(n)
+		setLog()
+	}
+
+	networks, err := ctx.ParseNetworks(trustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid -trusted-proxies")
+	}
+	trustedNetworks = networks
+
+	predicate.StartAsync(asyncWorkers, asyncQueue)
+	load(cfg)
+	done := make(chan struct{})
+	watch(watchInterval, done)
 
 	for k := range plugins.List() {
 		log.Info().Str("plugin", k).Msg("Plugin enabled")
@@ -94,8 +251,51 @@ func main() {
 
 	server := http.NewServeMux()
 	server.HandleFunc("/", handler)
-	log.Info().Str("app", "started").Int("port", port).
-		Msgf("Application started and listening to :%v", port)
+	if metricsPath != "" {
+		server.Handle(metricsPath, expvar.Handler())
+		log.Info().Str("path", metricsPath).Msg("Metrics enabled")
+	}
+	tlsCfg, cert, err := tlsConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid TLS configuration")
+	}
+	if cert != nil {
+		cert.watch(watchInterval, done)
+	}
+	srv := &http.Server{
+		Handler:        stripPrefix(basePath, server),
+		TLSConfig:      tlsCfg,
+		ReadTimeout:    readTimeout,
+		WriteTimeout:   writeTimeout,
+		IdleTimeout:    idleTimeout,
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+	ln, err := listener()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Cannot listen")
+	}
+	log.Info().Str("app", "started").Str("listen", ln.Addr().String()).
+		Bool("tls", tlsCfg != nil).
+		Msgf("Application started and listening to %v", ln.Addr())
 
-	log.Fatal().Err(http.ListenAndServe(":"+strconv.Itoa(port), server)).Msg("")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	errs := make(chan error, 1)
+	go func() {
+		if tlsCfg != nil {
+			errs <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errs <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errs:
+		log.Fatal().Err(err).Msg("")
+	case sig := <-stop:
+		log.Info().Str("signal", sig.String()).Msg("Shutting down")
+	}
+	signal.Stop(stop)
+	close(done)
+	shutdown(srv, current.Load().(*state), shutdownTimeout)
+	log.Info().Str("app", "stopped").Msg("Application stopped")
 }
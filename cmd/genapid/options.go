@@ -0,0 +1,72 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// options set by the 'options' statement of the conf
+type options struct {
+	// Stop processing the request after the first top-level pipe
+	// whose predicates are all true
+	FirstMatch bool `yaml:"first_match"`
+}
+
+// Remove the 'options' statement from the top level of cfg and
+// returns the options it sets
+func processOptions(cfg *conf.Root) options {
+	var opts options
+	root := conf.Root{}
+	found := false
+	for _, p := range *cfg {
+		n, ok := p["options"]
+		if !ok {
+			root = append(root, p)
+			continue
+		}
+		if found {
+			log.Error().Err(errors.New("'options' set several times")).Msg("")
+			continue
+		}
+		found = true
+		if len(p) > 1 {
+			log.Error().Err(errors.New("'options' must be used alone")).Msg("")
+			continue
+		}
+		o, err := parseOptions(&n)
+		if err != nil {
+			log.Error().Err(err).Msg("")
+			continue
+		}
+		opts = o
+	}
+	*cfg = root
+	return opts
+}
+
+// Decode the content of an 'options' statement
+func parseOptions(n *yaml.Node) (options, error) {
+	var opts options
+	if n.Kind != yaml.MappingNode {
+		return opts, errors.New("'options' must be a dict")
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		switch k := n.Content[i].Value; k {
+		case "first_match":
+		default:
+			return opts, fmt.Errorf("unknown option '%v'", k)
+		}
+	}
+	if err := n.Decode(&opts); err != nil {
+		return opts, fmt.Errorf("invalid 'options': %w", err)
+	}
+	return opts, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/rs/zerolog/log"
+)
+
+// Read the conf file again and make it the current one. If the new
+// conf is invalid, the current one is kept.
+func reload() bool {
+	cfg, err := conf.ReadConfFile(configFileName)
+	if err != nil {
+		logConfError(err)
+		log.Error().Msg("Cannot reload conf, keeping current one")
+		return false
+	}
+	if decodeServer(serverStatement(cfg.Root)) != startServer {
+		log.Warn().Msg("'server' changed, restart genapid to apply it")
+	}
+	load(cfg)
+	log.Info().Msg("Conf reloaded")
+	return true
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stamps(files []string) map[string]fileStamp {
+	s := make(map[string]fileStamp, len(files))
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			s[f] = fileStamp{info.ModTime(), info.Size()}
+		} else {
+			// file removed, will be seen as changed when
+			// it comes back
+			s[f] = fileStamp{}
+		}
+	}
+	return s
+}
+
+func changed(old, new map[string]fileStamp) bool {
+	for f, s := range new {
+		if old[f] != s {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload the conf when one of its files is modified, checking every
+// interval, or when SIGHUP is received, until done is closed
+func watch(interval time.Duration, done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+	last := stamps(current.Load().(*state).files)
+	go func() {
+		defer signal.Stop(hup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				log.Info().Msg("SIGHUP received, reloading conf")
+			case <-tick:
+				s := stamps(current.Load().(*state).files)
+				if !changed(last, s) {
+					continue
+				}
+				log.Info().Msg("Conf files changed, reloading conf")
+			}
+			// if the new conf is invalid, we wait for the
+			// files to be changed again
+			reload()
+			last = stamps(current.Load().(*state).files)
+		}
+	}()
+}
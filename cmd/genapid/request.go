@@ -5,35 +5,130 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
+	"strings"
 
 	"github.com/jsautret/genapid/app/predicate"
+	"github.com/jsautret/genapid/app/router"
 	"github.com/jsautret/genapid/ctx"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 // Process incoming request
-func process(w http.ResponseWriter, r *http.Request, c *ctx.Ctx) bool {
+func process(w http.ResponseWriter, r *http.Request,
+	s *state, c *ctx.Ctx) bool {
+	id := requestID(r)
+	w.Header().Set("X-Request-Id", id)
+	// logs of the request, including its async predicates
+	log := log.With().Str("request", id).Logger()
 	log.Debug().Str("http", "start").Str("path", r.URL.Path).
 		Msg("Processing HTTP request")
 
 	log.Trace().Interface("headers", r.Header).Msg("")
 
+	// predicates reading the body get an error past the limit
+	if r.Body != nil && s.maxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodySize)
+	}
+
 	// init context structures with incoming request
 	c.In = r
+	c.Req = ctx.NewRequest(r, trustedNetworks)
+	c.Response = nil
+	c.Stopped = false
+	c.P = map[string]string{}
+
+	// predicates are cancelled if the caller disconnects or if the
+	// request takes too long
+	gc, cancel := r.Context(), context.CancelFunc(func() {})
+	if requestTimeout > 0 {
+		gc, cancel = context.WithTimeout(gc, requestTimeout)
+	}
+	defer cancel()
+	c.SetContext(gc)
+
+	// only the pipe with the route matching the request is evaluated,
+	// with the other predicates
+	route := -1
+	var allowed []string
+	if s.router != nil {
+		var m *router.Match
+		if m, allowed = s.router.Lookup(r.Method, r.URL.Path); m != nil {
+			route = m.Value.(int)
+			c.P = m.Params
+			log.Debug().Int("route", route).Msg("Route found")
+		}
+	}
 
 	// Process each pipe
-	var res bool
-	for i := 0; i < len(config); i++ {
-		pc := config[i]
-		res = predicate.Process(log.Logger, &pc, c)
-		if !res {
+	var res, matched bool
+	for i := 0; i < len(s.config); i++ {
+		pc := s.config[i]
+		if _, ok := pc["route"]; ok && i != route {
+			continue
+		}
+		res, matched = predicate.ProcessRoute(log, &pc, c)
+		if !res || c.Stopped {
+			break
+		}
+		if matched && s.options.FirstMatch {
+			log.Debug().Msg("First match")
 			break
 		}
 	}
+	if s.router != nil && route == -1 && c.Response == nil {
+		c.Response = noRouteResponse(allowed)
+	}
+	writeResponse(log, w, c.Response)
 	log.Debug().Str("http", "end").Str("path", r.URL.Path).
 		Msg("HTTP request processed")
 	// return result of last predicate in pipe
 	// used for tests
 	return res
 }
+
+// Returns the ID of the request, from its X-Request-Id header or a new
+// random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Warn().Err(err).Msg("Cannot generate request ID")
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns the response sent when no route matches the request: a 405
+// if some routes match its path with other methods, a 404 otherwise
+func noRouteResponse(allowed []string) *ctx.Response {
+	code := http.StatusNotFound
+	headers := map[string]string{}
+	if len(allowed) != 0 {
+		code = http.StatusMethodNotAllowed
+		headers["Allow"] = strings.Join(allowed, ", ")
+	}
+	resp := ctx.NewResponse(code, headers)
+	resp.SetString(http.StatusText(code))
+	return resp
+}
+
+// Send the response set by the 'response' predicate. If none was
+// set, an empty 200 is sent.
+func writeResponse(log zerolog.Logger, w http.ResponseWriter, resp *ctx.Response) {
+	if resp == nil {
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.Code)
+	if _, err := w.Write(resp.Body); err != nil {
+		log.Warn().Err(err).Msg("Cannot write response")
+	}
+}
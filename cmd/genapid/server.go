@@ -0,0 +1,292 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Server flags variables
+var (
+	listenAddr     string
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	maxHeaderBytes int
+	maxBodySize    int64
+	basePath       string
+	logFormat      string
+)
+
+// Server flags definitions
+func serverFlags() {
+	flag.StringVar(&listenAddr, "listen", "",
+		"Listening address, like 127.0.0.1:9110 or unix:/run/genapid.sock, overrides -port")
+	flag.DurationVar(&readTimeout, "read-timeout", 0,
+		"Maximum duration of the reading of a request, 0 for no limit")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0,
+		"Maximum duration between the end of the reading of a request & the end of its response, 0 for no limit")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0,
+		"Maximum duration of keep-alive connections between requests, 0 for no limit")
+	flag.IntVar(&maxHeaderBytes, "max-header-size", http.DefaultMaxHeaderBytes,
+		"Maximum size of the headers of a request, in bytes")
+	flag.Int64Var(&maxBodySize, "max-body-size", 1<<20,
+		"Maximum size of the body of a request, in bytes, 0 for no limit")
+	flag.StringVar(&basePath, "base-path", "",
+		"Path prefix of the requests, removed before they are processed")
+	flag.StringVar(&logFormat, "log-format", "auto",
+		"Log format: 'json', 'console' or 'auto' for console when output is a terminal")
+}
+
+// server holds the settings of the 'server' statement of the conf,
+// used to validate them. Each setting sets the flag named by its
+// 'flag' tag, unless this flag is set on the command line or by its
+// environment variable.
+type server struct {
+	Listen          string        `yaml:"listen" flag:"listen" validate:"omitempty,hostname_port|startswith=unix:"`
+	Port            int           `yaml:"port" flag:"port" validate:"gte=0,lte=65535"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" flag:"read-timeout" validate:"gte=0"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" flag:"write-timeout" validate:"gte=0"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" flag:"idle-timeout" validate:"gte=0"`
+	RequestTimeout  time.Duration `yaml:"request_timeout" flag:"request-timeout" validate:"gte=0"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" flag:"shutdown-timeout" validate:"gte=0"`
+	MaxHeaderSize   int           `yaml:"max_header_size" flag:"max-header-size" validate:"gte=0"`
+	MaxBodySize     int64         `yaml:"max_body_size" flag:"max-body-size" validate:"gte=0"`
+	BasePath        string        `yaml:"base_path" flag:"base-path" validate:"omitempty,startswith=/"`
+	TrustedProxies  string        `yaml:"trusted_proxies" flag:"trusted-proxies"`
+	LogLevel        string        `yaml:"log_level" flag:"loglevel" validate:"omitempty,oneof=panic fatal error warn info debug trace"`
+	LogFormat       string        `yaml:"log_format" flag:"log-format" validate:"omitempty,oneof=auto json console"`
+	Metrics         string        `yaml:"metrics" flag:"metrics" validate:"omitempty,startswith=/"`
+}
+
+var serverValidate = validator.New()
+
+// Settings of the 'server' statement applied when genapid started
+var startServer server
+
+// Returns the settings of the 'server' statement n, which may be nil
+func decodeServer(n *yaml.Node) server {
+	s := server{}
+	if n != nil {
+		n.Decode(&s) // nolint:errcheck
+	}
+	return s
+}
+
+// Returns the fields of server, by setting name
+func serverSettings() map[string]reflect.StructField {
+	settings := map[string]reflect.StructField{}
+	t := reflect.TypeOf(server{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		settings[f.Tag.Get("yaml")] = f
+	}
+	return settings
+}
+
+// Returns the 'server' statement of cfg, nil if none
+func serverStatement(cfg conf.Root) *yaml.Node {
+	for _, p := range cfg {
+		if n, ok := p["server"]; ok {
+			return &n
+		}
+	}
+	return nil
+}
+
+// Remove the 'server' statement from the top level of cfg. It is
+// applied by applyServer when genapid starts, and not when the conf is
+// reloaded.
+func processServer(cfg *conf.Root) {
+	root := conf.Root{}
+	found := false
+	for _, p := range *cfg {
+		if _, ok := p["server"]; !ok {
+			root = append(root, p)
+			continue
+		}
+		if found {
+			log.Error().Err(errors.New("'server' set several times")).Msg("")
+		}
+		found = true
+		if len(p) > 1 {
+			log.Error().Err(errors.New("'server' must be used alone")).Msg("")
+		}
+	}
+	*cfg = root
+}
+
+// Decode & validate the content of a 'server' statement. The errors
+// are positioned on the invalid settings.
+func parseServer(n *yaml.Node) conf.Errors {
+	if n.Kind != yaml.MappingNode {
+		return conf.Errors{{Line: n.Line, Column: n.Column,
+			Err: errors.New("'server' must be a dict")}}
+	}
+	var errs conf.Errors
+	add := func(n *yaml.Node, err error) {
+		errs = append(errs, &conf.Error{Line: n.Line, Column: n.Column,
+			Err: err})
+	}
+	settings := serverSettings()
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		f, ok := settings[k.Value]
+		if !ok {
+			add(k, fmt.Errorf("unknown setting '%v' for 'server'", k.Value))
+			continue
+		}
+		// decode & validate each setting separately to know which
+		// one is wrong. The value must also be accepted by its flag,
+		// as it is set by applyServer.
+		s := server{}
+		mapping := &yaml.Node{Kind: yaml.MappingNode,
+			Content: []*yaml.Node{k, v}}
+		if v.Kind != yaml.ScalarNode || mapping.Decode(&s) != nil ||
+			checkFlag(f.Tag.Get("flag"), v.Value) != nil {
+			add(v, fmt.Errorf("'%v': invalid value", k.Value))
+			continue
+		}
+		err := serverValidate.StructPartial(s, f.Name)
+		var verrs validator.ValidationErrors
+		if errors.As(err, &verrs) {
+			add(v, fmt.Errorf("'%v': failed on '%v' validation",
+				k.Value, verrs[0].Tag()))
+			continue
+		}
+		if f.Name == "TrustedProxies" {
+			if _, err := ctx.ParseNetworks(s.TrustedProxies); err != nil {
+				add(v, fmt.Errorf("'%v': %w", k.Value, err))
+			}
+		}
+	}
+	return errs
+}
+
+// Returns an error if the flag name does not accept value, without
+// setting the flag
+func checkFlag(name, value string) error {
+	f := flag.Lookup(name)
+	// a new value of the same type, to use the same parser
+	v := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+	return v.Set(value)
+}
+
+// Set the flags of fs from the settings of the 'server' statement n,
+// except the ones in set
+func applyServer(fs *flag.FlagSet, n *yaml.Node, set map[string]bool) error {
+	settings := serverSettings()
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		name := settings[n.Content[i].Value].Tag.Get("flag")
+		if set[name] {
+			log.Debug().Str("flag", name).
+				Msg("Setting of 'server' overridden")
+			continue
+		}
+		if err := fs.Set(name, n.Content[i+1].Value); err != nil {
+			return fmt.Errorf("'%v': %w", n.Content[i].Value, err)
+		}
+	}
+	return nil
+}
+
+// Returns the environment variable that sets the flag name, like
+// GENAPID_TLS_CERT for tls-cert
+func envName(name string) string {
+	return "GENAPID_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Set the flags of fs that are not set on the command line from their
+// environment variable. Returns the names of the flags set by either.
+func envFlags(fs *flag.FlagSet) (map[string]bool, error) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if set[f.Name] || !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid %v: %w", envName(f.Name), e)
+			return
+		}
+		set[f.Name] = true
+	})
+	return set, err
+}
+
+// Returns the listener set by -listen, or by -port if not set
+func listener() (net.Listener, error) {
+	if path := strings.TrimPrefix(listenAddr, "unix:"); path != listenAddr {
+		if info, err := os.Stat(path); err == nil &&
+			info.Mode()&os.ModeSocket != 0 {
+			if err := removeSocket(path); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	addr := listenAddr
+	if addr == "" {
+		addr = ":" + strconv.Itoa(port)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Remove the socket left by a previous run at path. Returns an error
+// if it is still used by a running one.
+func removeSocket(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close() // nolint:errcheck
+		return fmt.Errorf("listen unix %v: address in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Returns a handler serving the requests whose path starts with
+// prefix with h, after removing prefix from their path. The other
+// requests get a 404.
+func stripPrefix(prefix string, h http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if len(p) == len(r.URL.Path) || p != "" && p[0] != '/' {
+			http.NotFound(w, r)
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+		r2 := r.WithContext(r.Context())
+		u := *r.URL
+		u.Path, u.RawPath = p, ""
+		r2.URL = &u
+		h.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/app/predicate"
+	"github.com/rs/zerolog/log"
+)
+
+// Remove the 'shutdown' statement from the top level of cfg and
+// returns its predicates
+func processShutdown(cfg *conf.Root) initValues {
+	var predicates initValues
+	root := conf.Root{}
+	found := false
+	for _, p := range *cfg {
+		n, ok := p["shutdown"]
+		if !ok {
+			root = append(root, p)
+			continue
+		}
+		if found {
+			log.Error().Err(errors.New("'shutdown' set several times")).Msg("")
+			continue
+		}
+		found = true
+		if len(p) > 1 {
+			log.Error().Err(errors.New("'shutdown' must be used alone")).Msg("")
+			continue
+		}
+		if err := n.Decode(&predicates); err != nil {
+			log.Error().Err(errors.New("Invalid values for 'shutdown'")).Msg("")
+		}
+	}
+	*cfg = root
+	return predicates
+}
+
+// Stop srv: new connections are refused and the requests being
+// processed & the async predicates are waited for, up to timeout (0
+// for no limit). The requests still running afterwards are
+// cancelled. Then the 'shutdown' statement of s is evaluated.
+func shutdown(srv *http.Server, s *state, timeout time.Duration) {
+	gc := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		gc, cancel = context.WithTimeout(gc, timeout)
+		defer cancel()
+	}
+	if err := srv.Shutdown(gc); err != nil {
+		log.Warn().Err(err).Msg("Requests not done, closing connections")
+		srv.Close() // nolint:errcheck
+	}
+
+	async := make(chan struct{})
+	go func() {
+		predicate.WaitAsync()
+		close(async)
+	}()
+	select {
+	case <-async:
+	case <-gc.Done():
+		log.Warn().Msg("Async predicates not done")
+	}
+
+	if len(s.shutdown) > 0 {
+		log.Info().Msg("Processing shutdown")
+		processList(s.shutdown, s.ctx.Fork())
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS flags variables
+var (
+	tlsCert       string
+	tlsKey        string
+	tlsClientCA   string
+	tlsClientAuth string
+	acmeDomains   string
+	acmeCache     string
+	acmeEmail     string
+	acmeDirectory string
+	acmeCA        string
+)
+
+// TLS flags definitions, set with the other ones
+func tlsFlags() {
+	flag.StringVar(&tlsCert, "tls-cert", "",
+		"Certificate file, serve HTTPS if set with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file of -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "",
+		"CA file used to verify client certificates")
+	flag.StringVar(&tlsClientAuth, "tls-client-auth", "require",
+		"With -tls-client-ca: 'require' a client certificate or verify it only if 'optional'")
+	flag.StringVar(&acmeDomains, "acme-domains", "",
+		"Comma separated domains to get certificates for with ACME, serve HTTPS if set")
+	flag.StringVar(&acmeCache, "acme-cache", "acme-cache",
+		"Directory where ACME certificates are stored")
+	flag.StringVar(&acmeEmail, "acme-email", "",
+		"Contact email sent to the ACME server")
+	flag.StringVar(&acmeDirectory, "acme-directory", autocert.DefaultACMEDirectory,
+		"ACME server directory URL")
+	flag.StringVar(&acmeCA, "acme-ca", "",
+		"CA file used to verify the ACME server, e.g. for a local test server")
+}
+
+// certificate is a key pair read from files, reloaded when they are
+// modified
+type certificate struct {
+	certFile, keyFile string
+	lock              sync.RWMutex
+	cert              *tls.Certificate
+	stamps            map[string]fileStamp
+}
+
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read the key pair from the files
+func (c *certificate) load() error {
+	s := stamps([]string{c.certFile, c.keyFile})
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Cannot load certificate: %w", err)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert, c.stamps = &cert, s
+	return nil
+}
+
+// Read the key pair again if the files were modified. If it is
+// invalid, the current one is kept.
+func (c *certificate) reload() {
+	c.lock.RLock()
+	last := c.stamps
+	c.lock.RUnlock()
+	if !changed(last, stamps([]string{c.certFile, c.keyFile})) {
+		return
+	}
+	if err := c.load(); err != nil {
+		log.Error().Err(err).Msg("Keeping current certificate")
+		return
+	}
+	log.Info().Str("cert", c.certFile).Msg("Certificate reloaded")
+}
+
+// Reload the key pair when it is modified, checking every interval,
+// until done is closed
+func (c *certificate) watch(interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.reload()
+			}
+		}
+	}()
+}
+
+// Used as tls.Config.GetCertificate
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// Returns the TLS configuration set by the flags, nil if HTTPS is not
+// enabled. The certificate read from files is returned so it can be
+// watched.
+func tlsConfig() (*tls.Config, *certificate, error) {
+	var cfg *tls.Config
+	var cert *certificate
+	switch {
+	case acmeDomains != "" && (tlsCert != "" || tlsKey != ""):
+		return nil, nil, errors.New("-acme-domains cannot be set with -tls-cert & -tls-key")
+	case acmeDomains != "":
+		m, err := acmeManager()
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg = m.TLSConfig()
+	case tlsCert != "" && tlsKey != "":
+		var err error
+		if cert, err = loadCertificate(tlsCert, tlsKey); err != nil {
+			return nil, nil, err
+		}
+		cfg = &tls.Config{GetCertificate: cert.get}
+	case tlsCert != "" || tlsKey != "":
+		return nil, nil, errors.New("-tls-cert & -tls-key must be set together")
+	case tlsClientCA != "":
+		return nil, nil, errors.New("-tls-client-ca requires HTTPS")
+	default:
+		return nil, nil, nil
+	}
+	cfg.MinVersion = tls.VersionTLS12
+
+	if tlsClientCA != "" {
+		pool, err := certPool(tlsClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.ClientCAs = pool
+		switch tlsClientAuth {
+		case "require":
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, nil, fmt.Errorf("invalid -tls-client-auth '%v'", tlsClientAuth)
+		}
+	}
+	return cfg, cert, nil
+}
+
+// Returns the ACME certificates manager set by the flags
+func acmeManager() (*autocert.Manager, error) {
+	var domains []string
+	for _, d := range strings.Split(acmeDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	client := &acme.Client{DirectoryURL: acmeDirectory}
+	if acmeCA != "" {
+		pool, err := certPool(acmeCA)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(acmeCache),
+		Email:      acmeEmail,
+		Client:     client,
+	}, nil
+}
+
+// Returns the certificates in PEM file
+func certPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %v", file)
+	}
+	return pool, nil
+}
@@ -8,8 +8,16 @@
 package ctx
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+
+	"github.com/PaesslerAG/gval"
 )
 
 // Ctx is the main entry point to the context
@@ -17,6 +25,13 @@ type Ctx struct {
 	// Incoming request
 	In *http.Request
 
+	// View of the incoming request, for expressions
+	Req *Request
+
+	// Parameters of the path of the request, set by the 'route'
+	// option of the pipe handling it
+	P map[string]string
+
 	// Default predicates values, set by 'default' predicate
 	Default Default
 
@@ -29,18 +44,207 @@ type Ctx struct {
 
 	// Value of last evaluated predicate
 	Result bool
+
+	// Current element of the list set by the 'loop' option, and its
+	// index in the list
+	Item  interface{}
+	Index int
+
+	// Last predicate that was false, used by the 'rescue' section of
+	// pipes
+	Failed *Failure
+
+	// Response sent back to the caller, set by 'response' predicate
+	Response *Response
+
+	// Set by the 'stop' predicate: no more predicates are evaluated
+	// for the request
+	Stopped bool
+
+	// Pipes set with 'define' in the conf, by name. Set when the conf
+	// is loaded and never modified afterwards.
+	Defined map[string]interface{}
+
+	// Gval expressions of the conf, compiled when the conf is
+	// loaded, by source string. Never modified afterwards.
+	Expressions map[string]gval.Evaluable
+
+	// Cancelled when the incoming request is done or times out, or
+	// when the 'timeout' of the current predicate expires
+	context context.Context
+}
+
+// Context returns the context.Context that predicates must honor
+// while they are evaluated. It is never nil.
+func (c *Ctx) Context() context.Context {
+	if c.context == nil {
+		return context.Background()
+	}
+	return c.context
+}
+
+// SetContext sets the context.Context returned by Context
+func (c *Ctx) SetContext(gc context.Context) {
+	c.context = gc
 }
 
 // New returns a empty context
 func New() *Ctx {
 	return &Ctx{
 		In:      &http.Request{},
+		Req:     NewRequest(&http.Request{}, nil),
+		P:       map[string]string{},
 		Default: Default{},
 		R:       Registered{},
 		V:       Variables{},
 	}
 }
 
+// Fork returns a new context initialized with the values of c. The
+// variables, registered results and defaults set in the returned
+// context are not seen by c, so c can be safely shared by several
+// forks, as long as it is not modified.
+func (c *Ctx) Fork() *Ctx {
+	n := *c
+	n.V = make(Variables, len(c.V))
+	for k, v := range c.V {
+		n.V[k] = v
+	}
+	n.R = make(Registered, len(c.R))
+	for k, v := range c.R {
+		n.R[k] = v
+	}
+	n.Default = c.Default.Copy()
+	return &n
+}
+
+// ForkRequest is like Fork, with its own copy of In, so the fork can
+// read the body of the request while c or other forks read it. The
+// body is read first, so c must not be used concurrently.
+func (c *Ctx) ForkRequest() *Ctx {
+	n := c.Fork()
+	if c.In == nil || c.In.Body == nil || c.In.Body == http.NoBody {
+		return n
+	}
+	b, err := c.readBody()
+	n.In = c.In.WithContext(c.In.Context())
+	n.In.Body = bodyReader(b, err)
+	return n
+}
+
+// Read the body of In, once with Req if it is the view of In
+func (c *Ctx) readBody() ([]byte, error) {
+	if c.Req != nil && c.Req.in == c.In {
+		s, err := c.Req.Body()
+		return []byte(s), err
+	}
+	b, err := ioutil.ReadAll(c.In.Body)
+	c.In.Body = bodyReader(b, err)
+	return b, err
+}
+
+// Returns a body reading b, then failing with err if not nil
+func bodyReader(b []byte, err error) io.ReadCloser {
+	if err == nil {
+		return ioutil.NopCloser(bytes.NewReader(b))
+	}
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(b),
+		errReader{err}))
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// Failure describes a predicate that was false
+type Failure struct {
+	// Type of predicate ("pipe" for a pipe)
+	Predicate string
+	// Value of its 'name' option
+	Name string
+	// Why it failed
+	Error string
+}
+
+// Response is the HTTP response sent back to the caller
+type Response struct {
+	Code    int
+	Headers http.Header
+	Body    []byte
+}
+
+// NewResponse returns a Response with code and headers, without body
+func NewResponse(code int, headers map[string]string) *Response {
+	r := &Response{
+		Code:    code,
+		Headers: http.Header{},
+	}
+	for k, v := range headers {
+		r.Headers.Set(k, v)
+	}
+	return r
+}
+
+// ResponseParams are the params of the predicates setting the
+// response, like 'response' & 'stop'
+type ResponseParams struct {
+	Code    int               `validate:"omitempty,gte=100,lte=599"`
+	Headers map[string]string `validate:"dive,keys,required,endkeys" mapstructure:",omitempty"`
+	Body    *ResponseBody     `mapstructure:",omitempty"`
+}
+
+// ResponseBody is the body set in ResponseParams, a string or a
+// value encoded in JSON
+type ResponseBody struct {
+	JSON   interface{} `validate:"required_without_all=String,excluded_with=String"`
+	String string      `validate:"required_without_all=JSON,excluded_with=JSON"`
+}
+
+// Response returns the response set by p, with a 200 code if not set
+func (p *ResponseParams) Response() (*Response, error) {
+	code := p.Code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	r := NewResponse(code, p.Headers)
+	if p.Body != nil {
+		if JSON := p.Body.JSON; JSON != nil {
+			if err := r.SetJSON(JSON); err != nil {
+				return nil, fmt.Errorf("body is not JSON: %w", err)
+			}
+		}
+		if s := p.Body.String; s != "" {
+			r.SetString(s)
+		}
+	}
+	return r, nil
+}
+
+// SetJSON sets the body of r to v encoded in JSON, and its
+// Content-Type if not already set
+func (r *Response) SetJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.Body = b
+	r.setContentType("application/json")
+	return nil
+}
+
+// SetString sets the body of r to s, and its Content-Type if not
+// already set
+func (r *Response) SetString(s string) {
+	r.Body = []byte(s)
+	r.setContentType("text/plain; charset=utf-8")
+}
+
+func (r *Response) setContentType(t string) {
+	if r.Headers.Get("Content-Type") == "" {
+		r.Headers.Set("Content-Type", t)
+	}
+}
+
 // URL contains info about incoming URL
 type URL struct {
 	Params url.Values // map[string]string
@@ -58,5 +262,18 @@ type Variables map[string]interface{}
 // Default stores predicates values, set by 'default' predicate
 type Default map[string]DefaultParams
 
+// Copy returns a copy of the default values of all predicates
+func (d Default) Copy() Default {
+	n1 := Default{}
+	for k1, v1 := range d {
+		n2 := DefaultParams{}
+		for k2, v2 := range v1 {
+			n2[k2] = v2
+		}
+		n1[k1] = n2
+	}
+	return n1
+}
+
 // DefaultParams stores the default parameters for a predicate type
 type DefaultParams map[string]interface{}
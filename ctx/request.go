@@ -0,0 +1,213 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Request is a view of the incoming request easier to use in
+// expressions than In: missing values are empty strings instead of
+// errors.
+type Request struct {
+	// HTTP method
+	Method string
+	// Non-empty segments of the path of the URL
+	Path []string
+	// IP address of the client. If the request comes from a trusted
+	// proxy, it is read from the X-Forwarded-For header.
+	RemoteIP string
+	// Common name of the verified client certificate, empty if the
+	// client didn't send one
+	ClientCert string
+
+	in    *http.Request
+	query url.Values
+
+	// protects the fields below, read when first needed
+	lock     sync.Mutex
+	bodyRead bool
+	body     []byte
+	bodyErr  error
+	form     url.Values
+}
+
+// NewRequest returns the view of r. trusted are the networks of the
+// proxies allowed to set the X-Forwarded-For header.
+func NewRequest(r *http.Request, trusted []*net.IPNet) *Request {
+	req := &Request{
+		Method: r.Method,
+		Path:   []string{},
+		in:     r,
+		query:  url.Values{},
+	}
+	if r.URL != nil {
+		for _, s := range strings.Split(r.URL.Path, "/") {
+			if s != "" {
+				req.Path = append(req.Path, s)
+			}
+		}
+		req.query = r.URL.Query()
+	}
+	req.RemoteIP = remoteIP(r, trusted)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		req.ClientCert = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return req
+}
+
+// Query returns the first value of the URL query parameter name
+func (r *Request) Query(name string) string {
+	return r.query.Get(name)
+}
+
+// Header returns the first value of the header name, which is case
+// insensitive
+func (r *Request) Header(name string) string {
+	return r.in.Header.Get(name)
+}
+
+// Cookie returns the value of the cookie name
+func (r *Request) Cookie(name string) string {
+	c, err := r.in.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// Form returns the first value of the field name, from the body if it
+// is an URL encoded form, or from the URL query
+func (r *Request) Form(name string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.form == nil {
+		r.form = url.Values{}
+		ct, _, _ := mime.ParseMediaType(r.in.Header.Get("Content-Type"))
+		if ct == "application/x-www-form-urlencoded" {
+			b, err := r.readBody()
+			if err != nil {
+				r.form = nil
+				return "", err
+			}
+			if r.form, err = url.ParseQuery(string(b)); err != nil {
+				r.form = nil
+				return "", fmt.Errorf("invalid form: %w", err)
+			}
+		}
+		for k, v := range r.query {
+			r.form[k] = append(r.form[k], v...)
+		}
+	}
+	return r.form.Get(name), nil
+}
+
+// Body returns the body of the request. It is read once and can
+// still be read from In afterwards.
+func (r *Request) Body() (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	b, err := r.readBody()
+	return string(b), err
+}
+
+// Read the body of the request once, must be called with lock held
+func (r *Request) readBody() ([]byte, error) {
+	if r.bodyRead {
+		return r.body, r.bodyErr
+	}
+	r.bodyRead = true
+	if r.in.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(r.in.Body)
+	if err != nil {
+		r.bodyErr = fmt.Errorf("Error reading body: %w", err)
+	}
+	r.body = b
+	// the body can still be read by predicates
+	r.in.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return r.body, r.bodyErr
+}
+
+// Returns the IP address of the client of r. The X-Forwarded-For
+// header is read from right to left as long as the addresses are in
+// trusted.
+func remoteIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		f := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(f) == nil {
+			break
+		}
+		ip = f
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses a comma separated list of IP addresses or
+// CIDR networks, like "10.0.0.0/8,127.0.0.1"
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%v'", f)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%v'", f)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
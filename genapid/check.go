@@ -0,0 +1,142 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package genapid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/mitchellh/mapstructure"
+)
+
+// ParamError is a problem found on a parameter of a predicate
+type ParamError struct {
+	Param string // name of the parameter in conf
+	Err   error
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("'%v': %v", e.Param, e.Err)
+}
+
+// CheckPredicate decodes and validates the parameters of p set in
+// cfg, without evaluating p. Parameters containing Gval expressions
+// are skipped, as they are known only when the predicate is
+// evaluated. Missing parameters are not reported, as they may be set
+// by 'default'.
+func CheckPredicate(p Predicate, cfg *conf.Params) []error {
+	params := p.Params()
+	t := reflect.ValueOf(params)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		// nothing we can check
+		return nil
+	}
+	fields := fieldNames(t.Elem().Type())
+
+	var errs []error
+	byField := map[string]string{}
+	for k, v := range cfg.Conf {
+		f, ok := fields[strings.ToLower(k)]
+		if !ok {
+			errs = append(errs, &ParamError{k,
+				fmt.Errorf("unknown parameter for '%v'", cfg.Name)})
+			continue
+		}
+		if hasExpression(v) {
+			continue
+		}
+		// decode each param separately to know which one is wrong
+		if err := conf.DecodeParams(ctx.New(),
+			map[string]interface{}{k: v}, params); err != nil {
+			var merr *mapstructure.Error
+			if errors.As(err, &merr) {
+				err = errors.New(strings.Join(merr.Errors, ", "))
+			}
+			errs = append(errs, &ParamError{k, err})
+			continue
+		}
+		byField[f] = k
+	}
+	if len(byField) == 0 {
+		return errs
+	}
+	if err := modify.Struct(context.Background(), params); err != nil {
+		return append(errs, err)
+	}
+	// Params set by 'default' or by expressions are unknown, so
+	// we only keep errors on checked params
+	err := validate.Struct(params)
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		for _, e := range verrs {
+			k, ok := topField(e.StructNamespace(), byField)
+			if !ok {
+				continue
+			}
+			errs = append(errs, &ParamError{k,
+				fmt.Errorf("failed on '%v' validation", e.Tag())})
+		}
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Returns the param of the first field of namespace ns found in
+// byField. ns starts with the name of the params type if it's named.
+func topField(ns string, byField map[string]string) (string, bool) {
+	for _, f := range strings.Split(ns, ".") {
+		if k, ok := byField[f]; ok {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Returns struct field names of t, indexed by their lower case name in
+// conf
+func fieldNames(t reflect.Type) map[string]string {
+	names := map[string]string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// not exported
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("mapstructure"), ",")[0]; tag != "" {
+			name = tag
+		}
+		names[strings.ToLower(name)] = f.Name
+	}
+	return names
+}
+
+// Returns true if v contains a Gval expression
+func hasExpression(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return conf.IsExpression(v)
+	case map[string]interface{}:
+		for _, e := range v {
+			if hasExpression(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if hasExpression(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@
 package genapid
 
 //go:generate mockery --disable-version-string --log-level error --name Predicate
+//go:generate mockery --disable-version-string --log-level error --name ErrorPredicate
 
 import (
 	"context"
@@ -34,28 +35,66 @@ type Predicate interface {
 	Params() interface{}
 }
 
+// ErrorPredicate is a Predicate that can report an error, so that a
+// failure (a request that timed out, an invalid file...) can be
+// distinguished from a predicate that is simply false
+type ErrorPredicate interface {
+	Predicate
+	// Eval evaluates the predicate. The predicate is false if the
+	// returned error is not nil.
+	Eval(zerolog.Logger, *ctx.Ctx) (bool, error)
+}
+
+// Eval evaluates p, with its Eval method if it's an ErrorPredicate or
+// with Call otherwise
+func Eval(log zerolog.Logger, c *ctx.Ctx, p Predicate) (bool, error) {
+	if ep, ok := p.(ErrorPredicate); ok {
+		result, err := ep.Eval(log, c)
+		return result && err == nil, err
+	}
+	return p.Call(log, c), nil
+}
+
+// Call evaluates the ErrorPredicate p and logs its error if any. It
+// can be used to implement the Call method of an ErrorPredicate.
+func Call(log zerolog.Logger, c *ctx.Ctx, p ErrorPredicate) bool {
+	result, err := p.Eval(log, c)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		return false
+	}
+	return result
+}
+
 // InitPredicate sets the parameters from the conf
 func InitPredicate(log zerolog.Logger, c *ctx.Ctx,
 	p Predicate, cfg *conf.Params) bool {
+	if err := Init(c, p, cfg); err != nil {
+		log.Error().Err(err).Msg("")
+		return false
+	}
+	return true
+}
+
+// Init sets the parameters from the conf and returns an error if they
+// are not valid
+func Init(c *ctx.Ctx, p Predicate, cfg *conf.Params) error {
 	params := p.Params()
 	if !conf.GetPredicateParams(c, cfg, params) {
-		log.Error().Err(errors.New("Invalid params")).Msg("")
-		return false
+		return errors.New("Invalid params")
 	}
 
 	if t := reflect.ValueOf(params); t.Kind() == reflect.Ptr &&
 		t.Elem().Kind() == reflect.Struct {
 		if err := modify.Struct(context.Background(), params); err != nil {
-			log.Error().Err(err).Msg("")
-			return false
+			return err
 		}
 
 		if err := validate.Struct(params); err != nil {
-			log.Error().Err(err).Msg("")
-			return false
+			return err
 		}
 	}
-	return true
+	return nil
 }
 
 func init() {
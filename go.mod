@@ -1,6 +1,6 @@
 module github.com/jsautret/genapid
 
-go 1.14
+go 1.15
 
 require (
 	github.com/PaesslerAG/gval v1.1.0
@@ -25,6 +25,8 @@ require (
 	github.com/stretchr/testify v1.7.0
 	github.com/vishen/go-chromecast v0.2.10-0.20210325213221-ac359eecd3f3
 	github.com/ybbus/jsonrpc v2.1.2+incompatible
+	golang.org/x/crypto v0.0.0-20201124201722-c8d3bf9c5392
 	golang.org/x/sys v0.0.0-20210324051608-47abb6519492 // indirect
+	golang.org/x/text v0.3.4
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
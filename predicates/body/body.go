@@ -7,6 +7,7 @@ package bodypredicate
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
@@ -32,6 +33,12 @@ type Predicate struct {
 
 // Call evaluates the predicate
 func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if the
+// body cannot be read
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
 	p := predicate.params
 
 	log.Debug().Str("Type", p.Type).Msg("")
@@ -39,11 +46,11 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 
 	switch c.In.Method {
 	case "GET":
-		return false
+		return false, nil
 	case "HEAD":
-		return false
+		return false, nil
 	case "DELETE":
-		return false
+		return false, nil
 	}
 
 	if p.Mime != "" { // checking if content-type match
@@ -51,11 +58,11 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 		m, _, err := mime.ParseMediaType(contentType)
 		if err != nil {
 			log.Warn().Err(err).Msg("Cannot parse Content-Type")
-			return false
+			return false, nil
 		}
 		if m != p.Mime {
 			log.Debug().Msgf("Content-type %v doesn't match expected %v", m, p.Mime)
-			return false
+			return false, nil
 		}
 	}
 	if p.Type != "" {
@@ -67,8 +74,7 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 		case "string":
 			body, err := ioutil.ReadAll(tee)
 			if err != nil {
-				log.Error().Err(err).Msg("Error reading body")
-				return false
+				return false, fmt.Errorf("Error reading body: %w", err)
 			}
 			predicate.results = ctx.Result{"payload": string(body)}
 		case "json":
@@ -76,14 +82,14 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 			d := json.NewDecoder(tee)
 			if err := d.Decode(&result); err != nil {
 				log.Debug().Err(err).Msg("Invalid JSON")
-				return false
+				return false, nil
 			}
 			predicate.results = ctx.Result{"payload": result}
 		}
 		// Put back the body in case the predicate is used later
 		c.In.Body = ioutil.NopCloser(&b)
 	}
-	return true
+	return true, nil
 }
 
 // Generic interface //
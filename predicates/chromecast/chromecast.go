@@ -5,8 +5,11 @@
 package chromecastpredicate
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 
 	"github.com/jsautret/genapid/ctx"
 	"github.com/jsautret/genapid/genapid"
@@ -34,46 +37,75 @@ type Predicate struct {
 	}
 }
 
-var app *application.Application
+var (
+	app *application.Application
+	// app is shared by the predicates
+	appLock sync.Mutex
+)
 
 // Call evaluates the predicate
 func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
-	p := predicate.params
-	log.Debug().Str("tts", p.TTS).Msg("")
+	return genapid.Call(log, c, predicate)
+}
 
+// Eval evaluates the predicate, returning an error if the
+// message cannot be played
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
+	log.Debug().Str("tts", predicate.params.TTS).Msg("")
+
+	// the chromecast libraries don't support context.Context, so
+	// we stop waiting for them when it's done. play stops before
+	// casting if it's done in the meantime.
+	done := make(chan error, 1)
+	go func() {
+		done <- predicate.play(c.Context(), log)
+	}()
+	select {
+	case err := <-done:
+		return err == nil, err
+	case <-c.Context().Done():
+		return false, c.Context().Err()
+	}
+}
+
+// Send the text to speech to the device, unless gc is done before
+func (predicate *Predicate) play(gc context.Context, log zerolog.Logger) error {
+	p := predicate.params
 	b, err := ioutil.ReadFile(p.GoogleServiceAccount)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to open google service account file")
-		return false
+		return fmt.Errorf("Unable to open google service account file: %w", err)
+	}
+	appLock.Lock()
+	defer appLock.Unlock()
+	// the predicate may have returned while waiting for another one
+	if err := gc.Err(); err != nil {
+		return err
 	}
 	if app == nil {
-		// multi-thread safe?
 		app, err = castApplication(p.Addr, p.Port, p.ServerPort)
 		if err != nil {
-			log.Error().Err(err).Msg("unable to get cast application")
-			return false
+			return fmt.Errorf("unable to get cast application: %w", err)
 		}
 	}
 
 	data, err := tts.Create(p.TTS, b, p.LanguageCode, p.VoiceName, p.SpeakingRate, p.Pitch)
 	if err != nil {
-		log.Error().Err(err).Msg("")
-		return false
+		return err
+	}
+	if err := gc.Err(); err != nil {
+		return err
 	}
 	f, err := ioutil.TempFile("", "go-chromecast-tts")
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to create temp file")
-		return false
+		return fmt.Errorf("Unable to create temp file: %w", err)
 	}
 
 	if _, err := f.Write(data); err != nil {
-		log.Error().Err(err).Msg("Unable to write to temp file")
-		return false
+		return fmt.Errorf("Unable to write to temp file: %w", err)
 	}
 
 	if err := app.Load(f.Name(), "audio/mp3", false, false, false); err != nil {
-		log.Error().Err(err).Msg("unable to load media to device")
-		return false
+		return fmt.Errorf("unable to load media to device: %w", err)
 	}
 
 	if err := os.Remove(f.Name()); err != nil {
@@ -81,7 +113,7 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 		// we don't fail the predicate for that
 	}
 
-	return true
+	return nil
 }
 
 // Generic interface //
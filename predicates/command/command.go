@@ -6,6 +6,7 @@ package commandpredicate
 
 import (
 	"bytes"
+	"fmt"
 	"os/exec"
 	"strings"
 
@@ -32,12 +33,25 @@ type Predicate struct {
 
 // Call evaluates the predicate
 func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if the
+// command cannot be run
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
 	p := predicate.params
 
 	log.Debug().Str("Command", p.Cmd).Msg("")
 	log.Debug().Str("Chdir", p.Chdir).Msg("")
 
-	cmd := exec.Command(p.Cmd, p.Args...)
+	var cmd *exec.Cmd
+	if p.Background {
+		// must keep running after the request
+		cmd = exec.Command(p.Cmd, p.Args...)
+	} else {
+		// killed if the request or the predicate times out
+		cmd = exec.CommandContext(c.Context(), p.Cmd, p.Args...)
+	}
 
 	if p.Chdir != "" {
 		cmd.Dir = p.Chdir
@@ -45,10 +59,9 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 
 	if p.Background {
 		if err := cmd.Start(); err != nil {
-			log.Error().Err(err).Msg("Cannot start command")
-			return false
+			return false, fmt.Errorf("Cannot start command: %w", err)
 		}
-		return true
+		return true, nil
 	}
 	if p.Stdin != "" {
 		cmd.Stdin = strings.NewReader(p.Stdin)
@@ -59,20 +72,22 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 
 	r := ctx.Result{"rc": 0}
 	if err := cmd.Run(); err != nil {
+		if cerr := c.Context().Err(); cerr != nil {
+			return false, fmt.Errorf("Command killed: %w", cerr)
+		}
 		if exitError, ok := err.(*exec.ExitError); ok {
 			rc := exitError.ExitCode()
 			log.Debug().Int("rc", rc)
 			r["rc"] = rc
 		} else {
-			log.Error().Err(err).Msg("Cannot run command")
-			return false
+			return false, fmt.Errorf("Cannot run command: %w", err)
 		}
 	}
 	r["stdout"] = stdout.String()
 	r["stderr"] = stderr.String()
 
 	predicate.results = r
-	return r["rc"] == 0
+	return r["rc"] == 0, nil
 }
 
 // Generic interface //
@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -46,6 +45,12 @@ type basicAuth struct{ Username, Password string }
 
 // Call evaluates the predicate
 func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if the request
+// failed
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
 	p := predicate.params
 	client := &http.Client{}
 	var resp *http.Response
@@ -57,8 +62,7 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 	if p.Params != nil {
 		u, err := url.Parse(p.URL)
 		if err != nil {
-			log.Error().Err(err).Msg("Bad URL")
-			return false
+			return false, fmt.Errorf("Bad URL: %w", err)
 		}
 		q := u.Query()
 		for k, v := range p.Params {
@@ -70,14 +74,15 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 	log.Debug().Str("URL", p.URL).Msg("")
 	body, contentType := getBody(log, predicate)
 	if body == nil {
-		req, err = http.NewRequest(p.Method, p.URL, nil)
+		req, err = http.NewRequestWithContext(c.Context(), p.Method,
+			p.URL, nil)
 	} else {
 		log.Debug().Interface("Body", body).Msg("")
-		req, err = http.NewRequest(p.Method, p.URL, body)
+		req, err = http.NewRequestWithContext(c.Context(), p.Method,
+			p.URL, body)
 	}
 	if err != nil {
-		log.Error().Err(err).Msg("")
-		return false
+		return false, err
 	}
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
@@ -100,29 +105,26 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 	}
 	resp, err = client.Do(req)
 	if err != nil {
-		log.Error().Err(err).Msg("HTTP request failed")
-		return false
+		return false, fmt.Errorf("HTTP request failed: %w", err)
 	}
 	predicate.results = ctx.Result{}
 	switch p.Response {
 	case "JSON":
 		var result interface{}
 		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			log.Error().Err(err).Msg("Response is not JSON")
-			return false
+			return false, fmt.Errorf("Response is not JSON: %w", err)
 		}
 		predicate.results["response"] = result
 	default:
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			log.Error().Err(errors.New("Cannot read response body"))
-			return false
+			return false, fmt.Errorf("Cannot read response body: %w", err)
 		}
 		predicate.results["response"] = string(body)
 	}
 	predicate.results["type"] = resp.Header.Get("Content-Type")
 	predicate.results["code"] = resp.StatusCode
-	return true
+	return true, nil
 }
 
 func getBody(log zerolog.Logger, predicate *Predicate) (*bytes.Buffer, string) {
@@ -5,11 +5,14 @@
 package httppredicate
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/jsautret/genapid/app/conf"
 	"github.com/jsautret/genapid/ctx"
@@ -276,6 +279,30 @@ response: json
 	}
 }
 
+func TestHTTPTimeout(t *testing.T) {
+	zerolog.SetGlobalLevel(logLevel)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// hangs until the client gives up
+			<-r.Context().Done()
+		}))
+	t.Cleanup(srv.Close)
+
+	log := zerolog.Nop()
+	p := New()
+	c := ctx.New()
+	gc, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	c.SetContext(gc)
+	require.True(t, genapid.InitPredicate(log, c, p,
+		getConf(t, "url: "+srv.URL)))
+	result, err := genapid.Eval(log, c, p)
+	assert.False(t, result)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded),
+		"unexpected error %v", err)
+}
+
 /***************************************************************************
   HTTP server mock
   ***************************************************************************/
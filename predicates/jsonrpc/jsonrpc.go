@@ -5,8 +5,10 @@
 package jsonrpcpredicate
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"net/http"
 
 	"github.com/jsautret/genapid/ctx"
 	"github.com/jsautret/genapid/genapid"
@@ -33,9 +35,19 @@ type basicAuth struct{ Username, Password string }
 
 // Call evaluates the predicate
 func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if the
+// call failed
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
 	p := predicate.params
 	log = log.With().Str("procedure", p.Procedure).Logger()
-	opts := jsonrpc.RPCClientOpts{}
+	opts := jsonrpc.RPCClientOpts{
+		HTTPClient: &http.Client{
+			Transport: contextTransport{c.Context()},
+		},
+	}
 	if p.BasicAuth != nil {
 		log.Debug().Msg("Enabling basic auth")
 		auth := map[string]string{
@@ -44,9 +56,7 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 					p.BasicAuth.Username+":"+
 						p.BasicAuth.Password)),
 		}
-		opts = jsonrpc.RPCClientOpts{
-			CustomHeaders: auth,
-		}
+		opts.CustomHeaders = auth
 	}
 	rpcClient := jsonrpc.NewClientWithOpts(p.URL, &opts)
 	var result interface{}
@@ -57,13 +67,23 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 		err = rpcClient.CallFor(&result, p.Procedure)
 	}
 	if err != nil {
-		log.Warn().Err(err).Msg("jsonrpc call error")
-		return false
+		return false, fmt.Errorf("jsonrpc call error: %w", err)
 	}
 	log.Debug().Interface("result", result).Msg("Server response")
 	predicate.results = ctx.Result{"response": result}
 
-	return true
+	return true, nil
+}
+
+// contextTransport sends the HTTP requests of the jsonrpc client with
+// a context.Context, as the client doesn't support it
+type contextTransport struct {
+	ctx context.Context
+}
+
+// RoundTrip implements http.RoundTripper
+func (t contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(r.WithContext(t.ctx))
 }
 
 // Try to convert params to something that can be marshalled in json
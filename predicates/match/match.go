@@ -6,6 +6,7 @@ package matchpredicate
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 
 	"github.com/jsautret/genapid/ctx"
@@ -29,24 +30,29 @@ type Predicate struct {
 
 // Call evaluates the predicate
 func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if
+// 'regexp' is invalid
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
 	p := predicate.params
 	log.Debug().Str("string", p.String).Msg("")
 	if p.Value != "" {
 		log.Debug().Str("value", p.Value).Msg("")
-		return p.Value == p.String
+		return p.Value == p.String, nil
 	}
 	if p.Regexp != "" {
 		log.Debug().Str("regexp", p.Regexp).Msg("")
 
 		r, err := regexp.Compile(p.Regexp)
 		if err != nil {
-			log.Error().Err(err).Msg("invalid 'regexp'")
-			return false
+			return false, fmt.Errorf("invalid 'regexp': %w", err)
 		}
 		// get list of matches
 		res := r.FindStringSubmatch(p.String)
 		if len(res) == 0 {
-			return false
+			return false, nil
 		}
 		// get named matches
 		namedRes := make(map[string]string)
@@ -60,11 +66,10 @@ func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
 			"matches": res,
 			"named":   namedRes,
 		}
-		return true
+		return true, nil
 	}
 	// validate should prevent reaching this point
-	log.Error().Err(errors.New("Missing one of 'value' or 'regexp'")).Msg("")
-	return false
+	return false, errors.New("Missing one of 'value' or 'regexp'")
 }
 
 // Generic interface //
@@ -0,0 +1,87 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package querypredicate
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/rs/zerolog"
+)
+
+// Name of the predicate
+var Name = "query"
+
+// Predicate is a genapid.Predicate interface that describes the predicate
+type Predicate struct {
+	name   string
+	params struct { // Params accepted by the predicate
+		Name    string `validate:"required"`
+		Value   string `validate:"excluded_with=Regexp"`
+		Regexp  string `validate:"excluded_with=Value"`
+		Default string
+	}
+	result ctx.Result // value of query parameter
+}
+
+// Call evaluates the predicate
+func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if 'regexp' is
+// invalid
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
+	p := predicate.params
+
+	v, found := p.Default, false
+	if u := c.In.URL; u != nil {
+		if values := u.Query()[p.Name]; len(values) > 0 {
+			v, found = values[0], true
+		}
+	}
+	log.Debug().Str("name", p.Name).Str("value", v).Bool("found", found).Msg("")
+	predicate.result = ctx.Result{"value": v, "found": found}
+	if !found && p.Default == "" {
+		return false, nil
+	}
+	if p.Value != "" {
+		return v == p.Value, nil
+	}
+	if p.Regexp != "" {
+		r, err := regexp.Compile(p.Regexp)
+		if err != nil {
+			return false, fmt.Errorf("invalid 'regexp': %w", err)
+		}
+		return r.MatchString(v), nil
+	}
+	return true, nil
+}
+
+// Generic interface //
+
+// Result returns data set by the predicate
+func (predicate *Predicate) Result() ctx.Result {
+	return predicate.result
+}
+
+// Name returns the name of the predicate
+func (predicate *Predicate) Name() string {
+	return predicate.name
+}
+
+// Params returns a reference to a struct params accepted by the predicate
+func (predicate *Predicate) Params() interface{} {
+	return &predicate.params
+}
+
+// New returns a new Predicate
+func New() genapid.Predicate {
+	return &Predicate{
+		name: Name,
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package querypredicate
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/kr/pretty"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+var logLevel = zerolog.FatalLevel
+
+func TestQuery(t *testing.T) {
+	cases := []struct {
+		name         string
+		conf         string
+		url          string
+		expected     bool   // return of predicate
+		invalidParam bool   // true if params values are invalid
+		expError     bool   // predicate failed with an error
+		expValue     string // value in results
+	}{
+		{
+			name:         "NoConf",
+			conf:         "",
+			invalidParam: true,
+		},
+		{
+			name:         "ValueAndRegexp",
+			invalidParam: true,
+			conf: `
+name: lang
+value: en
+regexp: ^en$
+`,
+		},
+		{
+			name:     "Missing",
+			url:      "/?other=en",
+			expected: false,
+			conf: `
+name: lang
+`,
+		},
+		{
+			name:     "Default",
+			url:      "/",
+			expected: true,
+			expValue: "en",
+			conf: `
+name: lang
+default: en
+value: en
+`,
+		},
+		{
+			name:     "Found",
+			url:      "/?lang=fr&lang=en",
+			expected: true,
+			expValue: "fr",
+			conf: `
+name: lang
+default: en
+`,
+		},
+		{
+			name:     "Value",
+			url:      "/?lang=fr",
+			expected: false,
+			expValue: "fr",
+			conf: `
+name: lang
+value: en
+`,
+		},
+		{
+			name:     "Regexp",
+			url:      "/?lang=fr",
+			expected: true,
+			expValue: "fr",
+			conf: `
+name: lang
+regexp: ^(en|fr)$
+`,
+		},
+		{
+			name:     "InvalidRegexp",
+			url:      "/?lang=fr",
+			expError: true,
+			expValue: "fr",
+			conf: `
+name: lang
+regexp: (
+`,
+		},
+	}
+	zerolog.SetGlobalLevel(logLevel)
+	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().Caller().Timestamp().Logger()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := New()
+			cfg := getConf(t, tc.conf)
+			c := ctx.New()
+			if tc.url != "" {
+				c.In = httptest.NewRequest("GET", tc.url, nil)
+			}
+			init := genapid.InitPredicate(log, c, p, cfg)
+			assert.Equal(t, !tc.invalidParam, init, "initPredicate")
+			if init {
+				result, err := genapid.Eval(log, c, p)
+				assert.Equal(t, tc.expected, result, "bad predicate result")
+				assert.Equal(t, tc.expError, err != nil, "predicate error")
+				assert.Equal(t, tc.expValue, p.Result()["value"], "bad value")
+			}
+		})
+
+	}
+}
+
+/***************************************************************************
+  Helpers
+  ***************************************************************************/
+func getConf(t *testing.T, source string) *conf.Params {
+	c := conf.Params{}
+	require.Nil(t,
+		yaml.Unmarshal([]byte(source), &c.Conf), "YAML parsing failed")
+	t.Logf("Parsed YAML:\n%# v", pretty.Formatter(c))
+
+	return &c
+}
@@ -6,6 +6,7 @@ package readfilepredicate
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 
 	"github.com/jsautret/genapid/ctx"
@@ -29,38 +30,40 @@ type Predicate struct {
 
 // Call evaluates the predicate
 func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if the
+// file cannot be read or parsed
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
 	p := predicate.params
 	if p.YAML != "" {
 		log.Debug().Str("yaml", p.YAML).Msg("Reading file")
 		y, err := ioutil.ReadFile(p.YAML)
 		if err != nil {
-			log.Error().Err(err).Msg("")
-			return false
+			return false, err
 		}
 		var result interface{}
 		if err := yaml.Unmarshal(y, &result); err != nil {
-			log.Error().Err(err).Msg("Invalid YAML")
-			return false
+			return false, fmt.Errorf("Invalid YAML: %w", err)
 		}
 		predicate.results = ctx.Result{"content": result}
-		return true
+		return true, nil
 	}
 	if p.JSON != "" {
 		log.Debug().Str("json", p.JSON).Msg("Reading file")
 		j, err := ioutil.ReadFile(p.JSON)
 		if err != nil {
-			log.Error().Err(err).Msg("")
-			return false
+			return false, err
 		}
 		var result interface{}
 		if err := json.Unmarshal(j, &result); err != nil {
-			log.Error().Err(err).Msg("Invalid JSON")
-			return false
+			return false, fmt.Errorf("Invalid JSON: %w", err)
 		}
 		predicate.results = ctx.Result{"content": result}
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 // Generic interface //
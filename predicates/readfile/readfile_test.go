@@ -29,6 +29,7 @@ func TestMatch(t *testing.T) {
 		expResult    bool        // predicate result
 		invalidParam bool        // Params values are invalid
 		expResults   interface{} // regexp matches
+		expError     bool        // predicate failed with an error
 	}{
 		{
 			name:         "NoConf",
@@ -49,6 +50,7 @@ json: testdata/test1.json
 yaml: testdata/nofile.yaml
 `,
 			expResult: false,
+			expError:  true,
 		},
 		{
 			name: "InvalidYAML",
@@ -56,6 +58,7 @@ yaml: testdata/nofile.yaml
 yaml: testdata/invalid
 `,
 			expResult: false,
+			expError:  true,
 		},
 		{
 			name: "InvalidJSON",
@@ -63,6 +66,7 @@ yaml: testdata/invalid
 json: testdata/invalid
 `,
 			expResult: false,
+			expError:  true,
 		},
 		{
 			name: "NoFileJSON",
@@ -70,6 +74,7 @@ json: testdata/invalid
 json: testdata/nofile.yaml
 `,
 			expResult: false,
+			expError:  true,
 		},
 		{
 			name: "YAMLEmpty",
@@ -117,6 +122,8 @@ json: testdata/test1.json
 			if init {
 				assert.Equal(t,
 					tc.expResult, p.Call(log.Logger, c), "predicate result")
+				_, err := genapid.Eval(log.Logger, c, p)
+				assert.Equal(t, tc.expError, err != nil, "predicate error")
 				if diff := deep.Equal(tc.expResults, p.Result()["content"]); diff != nil {
 					t.Log(diff)
 				}
@@ -0,0 +1,64 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package responsepredicate
+
+import (
+	"errors"
+
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/rs/zerolog"
+)
+
+// Name of the predicate
+var Name = "response"
+
+// Predicate is a genapid.Predicate interface that describes the predicate
+type Predicate struct {
+	name   string
+	params ctx.ResponseParams // Params accepted by the predicate
+}
+
+// Call evaluates the predicate
+func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	if c.Response != nil {
+		// First response set wins
+		log.Warn().Err(errors.New("Response already set")).Msg("")
+		return false
+	}
+	r, err := predicate.params.Response()
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		return false
+	}
+	log.Debug().Int("code", r.Code).Msg("")
+	c.Response = r
+	return true
+}
+
+// Generic interface //
+
+// Result returns data set by the predicate
+func (predicate *Predicate) Result() ctx.Result {
+	// no data is set by response
+	return ctx.Result{}
+}
+
+// Name returns the name of the predicate
+func (predicate *Predicate) Name() string {
+	return predicate.name
+}
+
+// Params returns a reference to a struct params accepted by the predicate
+func (predicate *Predicate) Params() interface{} {
+	return &predicate.params
+}
+
+// New returns a new Predicate
+func New() genapid.Predicate {
+	return &Predicate{
+		name: Name,
+	}
+}
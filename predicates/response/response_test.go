@@ -0,0 +1,215 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package responsepredicate
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	stoppredicate "github.com/jsautret/genapid/predicates/stop"
+	"github.com/kr/pretty"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+var logLevel = zerolog.FatalLevel
+
+func TestResponse(t *testing.T) {
+	cases := []struct {
+		name         string
+		conf         string
+		stop         bool          // test the stop predicate
+		expected     bool          // return of predicate
+		invalidParam bool          // true if params values are invalid
+		already      bool          // a response is already set in ctx
+		expResp      *ctx.Response // response set in ctx
+	}{
+		{
+			name:     "NoConf",
+			conf:     "",
+			expected: true,
+			expResp: &ctx.Response{
+				Code:    http.StatusOK,
+				Headers: http.Header{},
+			},
+		},
+		{
+			name: "BadCode",
+			conf: `
+code: 42
+`,
+			invalidParam: true,
+		},
+		{
+			name: "BadBody",
+			conf: `
+body:
+  json:
+    k: v
+  string: content
+`,
+			invalidParam: true,
+		},
+		{
+			name:     "String",
+			expected: true,
+			conf: `
+code: 404
+body:
+  string: not found
+`,
+			expResp: &ctx.Response{
+				Code: http.StatusNotFound,
+				Headers: http.Header{
+					"Content-Type": []string{"text/plain; charset=utf-8"},
+				},
+				Body: []byte("not found"),
+			},
+		},
+		{
+			name:     "JSON",
+			expected: true,
+			conf: `
+headers:
+  X-Custom: value
+body:
+  json:
+    k: v
+`,
+			expResp: &ctx.Response{
+				Code: http.StatusOK,
+				Headers: http.Header{
+					"Content-Type": []string{"application/json"},
+					"X-Custom":     []string{"value"},
+				},
+				Body: []byte(`{"k":"v"}`),
+			},
+		},
+		{
+			name:     "ContentType",
+			expected: true,
+			conf: `
+headers:
+  content-type: application/xml
+body:
+  string: <xml/>
+`,
+			expResp: &ctx.Response{
+				Code: http.StatusOK,
+				Headers: http.Header{
+					"Content-Type": []string{"application/xml"},
+				},
+				Body: []byte("<xml/>"),
+			},
+		},
+		{
+			name:     "AlreadySet",
+			expected: false,
+			already:  true,
+			conf: `
+code: 500
+`,
+			expResp: &ctx.Response{Code: http.StatusAccepted},
+		},
+		// stop sets the response like response, if set
+		{
+			name:     "StopNoConf",
+			stop:     true,
+			expected: true,
+		},
+		{
+			name: "StopBadCode",
+			stop: true,
+			conf: `
+code: 42
+`,
+			invalidParam: true,
+		},
+		{
+			name:     "StopCode",
+			stop:     true,
+			expected: true,
+			conf: `
+code: 404
+`,
+			expResp: &ctx.Response{
+				Code:    http.StatusNotFound,
+				Headers: http.Header{},
+			},
+		},
+		{
+			name:     "StopBody",
+			stop:     true,
+			expected: true,
+			conf: `
+body:
+  json:
+    k: v
+`,
+			expResp: &ctx.Response{
+				Code: http.StatusOK,
+				Headers: http.Header{
+					"Content-Type": []string{"application/json"},
+				},
+				Body: []byte(`{"k":"v"}`),
+			},
+		},
+		{
+			name:     "StopAlreadySet",
+			stop:     true,
+			expected: true,
+			already:  true,
+			conf: `
+code: 500
+`,
+			expResp: &ctx.Response{Code: http.StatusAccepted},
+		},
+	}
+	zerolog.SetGlobalLevel(logLevel)
+	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().Caller().Timestamp().Logger()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := New()
+			if tc.stop {
+				p = stoppredicate.New()
+			}
+			cfg := getConf(t, tc.conf)
+			c := ctx.New()
+			if tc.already {
+				c.Response = &ctx.Response{Code: http.StatusAccepted}
+			}
+			init := genapid.InitPredicate(log, c, p, cfg)
+			assert.Equal(t, !tc.invalidParam, init, "initPredicate")
+			if init {
+				assert.Equal(t,
+					tc.expected, p.Call(log, c),
+					"bad predicate result")
+				assert.Equal(t, tc.expResp, c.Response,
+					"bad response")
+				assert.Equal(t, tc.stop, c.Stopped, "stopped")
+			}
+		})
+
+	}
+}
+
+/***************************************************************************
+  Helpers
+  ***************************************************************************/
+func getConf(t *testing.T, source string) *conf.Params {
+	c := conf.Params{}
+	require.Nil(t,
+		yaml.Unmarshal([]byte(source), &c.Conf), "YAML parsing failed")
+	t.Logf("Parsed YAML:\n%# v", pretty.Formatter(c))
+
+	return &c
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package stoppredicate
+
+import (
+	"errors"
+
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/rs/zerolog"
+)
+
+// Name of the predicate
+var Name = "stop"
+
+// Predicate is a genapid.Predicate interface that describes the predicate
+type Predicate struct {
+	name   string
+	params ctx.ResponseParams // Params accepted by the predicate
+}
+
+// Call evaluates the predicate
+func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval ends the processing of the request, after setting the
+// response if code, headers or body are set. It returns an error if
+// the response cannot be set.
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
+	p := predicate.params
+	c.Stopped = true
+	log.Debug().Msg("Stop processing request")
+
+	if p.Code == 0 && p.Headers == nil && p.Body == nil {
+		return true, nil
+	}
+	if c.Response != nil {
+		// First response set wins
+		log.Warn().Err(errors.New("Response already set")).Msg("")
+		return true, nil
+	}
+	r, err := p.Response()
+	if err != nil {
+		return false, err
+	}
+	c.Response = r
+	return true, nil
+}
+
+// Generic interface //
+
+// Result returns data set by the predicate
+func (predicate *Predicate) Result() ctx.Result {
+	// no data is set by stop
+	return ctx.Result{}
+}
+
+// Name returns the name of the predicate
+func (predicate *Predicate) Name() string {
+	return predicate.name
+}
+
+// Params returns a reference to a struct params accepted by the predicate
+func (predicate *Predicate) Params() interface{} {
+	return &predicate.params
+}
+
+// New returns a new Predicate
+func New() genapid.Predicate {
+	return &Predicate{
+		name: Name,
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package templatepredicate
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/rs/zerolog"
+)
+
+// Name of the predicate
+var Name = "template"
+
+// Predicate is the conf.Plugin interface that describes the predicate
+type Predicate struct {
+	name   string
+	params struct { // Params accepted by the predicate
+		Inline string `validate:"required_without=File,excluded_with=File"`
+		File   string `validate:"required_without=Inline,excluded_with=Inline" mod:"path"`
+	}
+	results ctx.Result // rendered text
+}
+
+// Call evaluates the predicate
+func (predicate *Predicate) Call(log zerolog.Logger, c *ctx.Ctx) bool {
+	return genapid.Call(log, c, predicate)
+}
+
+// Eval evaluates the predicate, returning an error if the
+// template cannot be read or rendered
+func (predicate *Predicate) Eval(log zerolog.Logger, c *ctx.Ctx) (bool, error) {
+	p := predicate.params
+	source := p.Inline
+	if p.File != "" {
+		log.Debug().Str("file", p.File).Msg("Reading template")
+		t, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return false, err
+		}
+		source = string(t)
+	}
+	text, err := conf.RenderTemplate(source, c)
+	if err != nil {
+		return false, fmt.Errorf("Cannot render template: %w", err)
+	}
+	log.Debug().Str("text", text).Msg("Template rendered")
+	predicate.results = ctx.Result{"text": text}
+	return true, nil
+}
+
+// Generic interface //
+
+// Result returns data set by the predicate
+func (predicate *Predicate) Result() ctx.Result {
+	return predicate.results
+}
+
+// Name returns the name of the predicate
+func (predicate *Predicate) Name() string {
+	return predicate.name
+}
+
+// Params returns a reference to the params struct of the predicate
+func (predicate *Predicate) Params() interface{} {
+	return &predicate.params
+}
+
+// New returns a new Predicate
+func New() genapid.Predicate {
+	return &Predicate{
+		name: Name,
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Jérôme Sautret. All rights reserved.  Use of this
+// source code is governed by an Apache License 2.0 that can be found
+// in the LICENSE file.
+
+package templatepredicate
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jsautret/genapid/app/conf"
+	"github.com/jsautret/genapid/ctx"
+	"github.com/jsautret/genapid/genapid"
+	"github.com/kr/pretty"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+var logLevel = zerolog.FatalLevel
+
+func TestTemplate(t *testing.T) {
+	cases := []struct {
+		name         string // Test name
+		conf         string // YAML conf
+		expResult    bool   // predicate result
+		invalidParam bool   // Params values are invalid
+		expText      string // rendered text
+	}{
+		{
+			name:         "NoConf",
+			conf:         "",
+			invalidParam: true,
+		},
+		{
+			name: "InlineAndFile",
+			conf: `
+inline: "{{ .V.name }}"
+file: testdata/message.tpl
+`,
+			invalidParam: true,
+		},
+		{
+			name: "Inline",
+			conf: `
+inline: '{{ .In.Method }} by {{ .V.name }} on {{ upper .V.host }}'
+`,
+			expResult: true,
+			expText:   "POST by Kodi on LIVING",
+		},
+		{
+			name: "Request",
+			conf: `
+inline: '{{ .Req.Query "room" }}'
+`,
+			expResult: true,
+			expText:   "kitchen",
+		},
+		{
+			name: "CtxMethod",
+			conf: `
+inline: '{{ .SetContext nil }}'
+`,
+			expResult: false,
+		},
+		{
+			name: "Default",
+			conf: `
+inline: '{{ .V.none | default "nobody" }}, {{ .V.name | default "nobody" }}'
+`,
+			expResult: true,
+			expText:   "nobody, Kodi",
+		},
+		{
+			name: "Expression",
+			conf: `
+inline: '="{{ .V.name }} " + V.host'
+`,
+			expResult: true,
+			expText:   "Kodi living",
+		},
+		{
+			name: "File",
+			conf: `
+file: testdata/message.tpl
+`,
+			expResult: true,
+			expText: `New push on genapid by someone:
+- Add templa...
+- Fix test
+2 commit(s)
+`,
+		},
+		{
+			name: "NoFile",
+			conf: `
+file: testdata/none.tpl
+`,
+			expResult: false,
+		},
+		{
+			name: "InvalidTemplate",
+			conf: `
+inline: '{{ .V.name'
+`,
+			expResult: false,
+		},
+		{
+			name: "ExecutionError",
+			conf: `
+inline: '{{ fromJSON .V.name }}'
+`,
+			expResult: false,
+		},
+	}
+
+	zerolog.SetGlobalLevel(logLevel)
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).
+		With().Caller().Timestamp().Logger()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := New()
+			cfg := getConf(t, tc.conf)
+			c := ctx.New()
+			c.In = httptest.NewRequest("POST", "/?room=kitchen", nil)
+			c.Req = ctx.NewRequest(c.In, nil)
+			c.V = ctx.Variables{"name": "Kodi", "host": "living"}
+			c.R = ctx.Registered{"push": ctx.Result{
+				"repository": "genapid",
+				"commits": []interface{}{
+					"Add template predicate", "Fix test"},
+			}}
+			init := genapid.InitPredicate(log.Logger, c, p, cfg)
+			assert.Equal(t, !tc.invalidParam, init, "initPredicate")
+			if init {
+				assert.Equal(t,
+					tc.expResult, p.Call(log.Logger, c), "predicate result")
+				if tc.expResult {
+					assert.Equal(t, tc.expText, p.Result()["text"])
+				}
+			}
+		})
+	}
+}
+
+/***************************************************************************
+  Helpers
+  ***************************************************************************/
+
+func getConf(t *testing.T, source string) *conf.Params {
+	c := conf.Params{}
+	require.Nil(t,
+		yaml.Unmarshal([]byte(source), &c.Conf), "YAML parsing failed")
+	t.Logf("Parsed YAML:\n%# v", pretty.Formatter(c))
+
+	return &c
+}
@@ -0,0 +1,5 @@
+New push on {{ .R.push.repository }} by {{ .R.push.pusher | default "someone" }}:
+{{ range .R.push.commits -}}
+- {{ truncate . 10 "..." }}
+{{ end -}}
+{{ len .R.push.commits }} commit(s)